@@ -0,0 +1,85 @@
+package manners
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Returns a handler that exposes the server's lifecycle over HTTP:
+//
+//	GET  /manners/stats     the open connections by state, as JSON
+//	POST /manners/drain     calls Drain
+//	POST /manners/shutdown  calls Close; with ?timeout=30s, closes the
+//	                        connections still open after the timeout
+//
+// The handler doesn't authenticate its callers, so serve it on a listener
+// only administrators can reach, such as one on localhost.
+func (s *GracefulServer) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manners/stats", s.serveStats)
+	mux.HandleFunc("/manners/drain", s.serveDrain)
+	mux.HandleFunc("/manners/shutdown", s.serveShutdown)
+	return mux
+}
+
+// The body of a /manners/stats response.
+type adminStats struct {
+	Connections int            `json:"connections"`
+	States      map[string]int `json:"states"`
+	Draining    bool           `json:"draining"`
+}
+
+func (s *GracefulServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	stats := adminStats{States: make(map[string]int), Draining: s.IsDraining()}
+	for state, n := range s.ConnectionStates() {
+		stats.States[state.String()] = n
+		stats.Connections += n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (s *GracefulServer) serveDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+	if err := s.Drain(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The shutdown happens in the background, as the admin handler may well be
+// served by the very server that is shutting down, which would otherwise
+// wait for this request to finish.
+func (s *GracefulServer) serveShutdown(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+	var timeout time.Duration
+	if v := r.FormValue("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			http.Error(w, "invalid timeout "+v, http.StatusBadRequest)
+			return
+		}
+	}
+	go s.BlockingCloseWithTimeout(timeout)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package manners
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests the stats reported by the admin handler.
+func TestAdminStats(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+	go func() {
+		if resp, err := http.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-ready
+
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/manners/stats", nil))
+	var stats adminStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Connections != 1 || stats.States["active"] != 1 || stats.Draining {
+		t.Fatalf("Expected 1 active connection, got %+v", stats)
+	}
+
+	release <- true
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests draining and shutting down through the admin handler, served by the
+// server it controls.
+func TestAdminLifecycle(t *testing.T) {
+	server := NewServer()
+	addr, exited := startServer(t, server, server.AdminHandler())
+	<-server.Listening()
+	client := &http.Client{Transport: &http.Transport{}}
+	post := func(path string) int {
+		resp, err := client.Post("http://"+addr+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("/manners/shutdown?timeout=bogus"); code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad timeout, got %d", code)
+	}
+	resp, err := client.Get("http://" + addr + "/manners/drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+	// The drain closes the listener; the keep-alive connection carries on.
+	if code := post("/manners/drain"); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 from drain, got %d", code)
+	}
+	if !server.IsDraining() {
+		t.Fatal("Expected the server to be draining")
+	}
+	if code := post("/manners/shutdown?timeout=1s"); code != http.StatusAccepted {
+		t.Fatalf("Expected 202 from shutdown, got %d", code)
+	}
+	client.CloseIdleConnections()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
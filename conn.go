@@ -0,0 +1,136 @@
+package manners
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A gracefulConn tells its server when it is closed. The inner server stops
+// reporting the state of a connection once it is hijacked, so this is how
+// the server learns that a hijacked connection it tracks has gone away.
+type gracefulConn struct {
+	net.Conn
+	server *GracefulServer
+	once   sync.Once
+}
+
+func (c *gracefulConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.server.hijackedClosed(c) })
+	return err
+}
+
+// A meteredConn counts the bytes read from and written to a connection, and
+// notes when it last did either, for ConnectionStats; see CountBytes.
+type meteredConn struct {
+	// Accessed atomically, and kept first so that they are 64-bit aligned.
+	bytesRead    uint64
+	bytesWritten uint64
+	lastActivity int64 // UnixNano
+
+	net.Conn
+}
+
+func newMeteredConn(conn net.Conn) *meteredConn {
+	return &meteredConn{Conn: conn, lastActivity: time.Now().UnixNano()}
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.bytesRead, uint64(n))
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddUint64(&c.bytesWritten, uint64(n))
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *meteredConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Returns the meteredConn underneath a connection as the inner server sees
+// it, or nil if there is none.
+func unwrapMeteredConn(conn net.Conn) *meteredConn {
+	for {
+		switch c := conn.(type) {
+		case *meteredConn:
+			return c
+		case *gracefulConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case netConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// Returns the proxyConn underneath a connection as the inner server sees
+// it, or nil if there is none.
+func unwrapProxyConn(conn net.Conn) *proxyConn {
+	for {
+		switch c := conn.(type) {
+		case *proxyConn:
+			return c
+		case *gracefulConn:
+			conn = c.Conn
+		case netConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// Returns the TCP connection underneath a connection as the inner server
+// sees it, or nil if there is none.
+func unwrapTCPConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case *gracefulConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case netConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// A connection wrapping another one, like a TLS connection.
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// Returns the gracefulConn underneath a connection as the inner server sees
+// it, which may be wrapped in a TLS connection or by a ConnWrapper. Returns
+// nil if there is none.
+func unwrapConn(conn net.Conn) *gracefulConn {
+	for {
+		switch c := conn.(type) {
+		case *gracefulConn:
+			return c
+		case netConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
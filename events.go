@@ -0,0 +1,90 @@
+package manners
+
+import "time"
+
+// How many events Events buffers for a slow reader before dropping them.
+const eventBuffer = 64
+
+// The stages of a shutdown reported by Events.
+type ShutdownEventType int
+
+const (
+	// Close was called. Count is the number of open connections.
+	EventInitiated ShutdownEventType = iota
+
+	// The listeners were closed. Count is the number of listeners.
+	EventListenerClosed
+
+	// Sent every DrainProgressInterval while the server drains. Count is
+	// the number of connections that remain.
+	EventProgressTick
+
+	// Connections were closed forcibly because the ShutdownTimeout or a
+	// DrainPolicy limit elapsed. Count is the number closed.
+	EventConnForceClosed
+
+	// The drain is over. Count is the number of connections that drained.
+	EventCompleted
+)
+
+func (t ShutdownEventType) String() string {
+	switch t {
+	case EventInitiated:
+		return "initiated"
+	case EventListenerClosed:
+		return "listener closed"
+	case EventProgressTick:
+		return "progress"
+	case EventConnForceClosed:
+		return "connections closed forcibly"
+	case EventCompleted:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// A step of a shutdown; see Events.
+type ShutdownEvent struct {
+	Type ShutdownEventType
+
+	// When the step happened.
+	Time time.Time
+
+	// What Count means depends on the Type.
+	Count int
+}
+
+// Returns a channel reporting the steps of the server's shutdown as they
+// happen, for building a timeline of the drain. The channel is buffered, and
+// events are dropped rather than holding up the drain when the buffer is
+// full. It is closed after EventCompleted.
+func (s *GracefulServer) Events() <-chan ShutdownEvent {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventsRead = true
+	return s.events
+}
+
+// Sends an event without blocking, and closes the channel after
+// EventCompleted.
+func (s *GracefulServer) emit(t ShutdownEventType, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emitLocked(t, count)
+}
+
+// Like emit, but must be called with s.mu held.
+func (s *GracefulServer) emitLocked(t ShutdownEventType, count int) {
+	if s.eventsClosed {
+		return
+	}
+	select {
+	case s.events <- ShutdownEvent{Type: t, Time: time.Now(), Count: count}:
+	default:
+	}
+	if t == EventCompleted {
+		close(s.events)
+		s.eventsClosed = true
+	}
+}
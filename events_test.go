@@ -0,0 +1,57 @@
+package manners
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Tests that Events reports each step of a shutdown that ends with a
+// connection being closed forcibly, and is closed afterwards.
+func TestEvents(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := NewServer()
+	server.ShutdownTimeout = 200 * time.Millisecond
+	server.DrainProgressInterval = 20 * time.Millisecond
+	events := server.Events()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+	server.Close()
+	<-exited
+
+	var types []ShutdownEventType
+	ticks := 0
+	for ev := range events {
+		if ev.Time.IsZero() {
+			t.Errorf("Expected the %v event to have a time", ev.Type)
+		}
+		switch ev.Type {
+		case EventInitiated, EventConnForceClosed:
+			if ev.Count != 1 {
+				t.Errorf("Expected a count of 1 for the %v event, got %d", ev.Type, ev.Count)
+			}
+		}
+		// A tick may race with the connection being closed.
+		if ev.Type == EventProgressTick {
+			ticks++
+			continue
+		}
+		types = append(types, ev.Type)
+	}
+	if ticks == 0 {
+		t.Error("Expected progress events during the drain")
+	}
+	want := []ShutdownEventType{EventInitiated, EventListenerClosed, EventConnForceClosed, EventCompleted}
+	if len(types) != len(want) {
+		t.Fatalf("Expected the events %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("Expected the events %v, got %v", want, types)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package manners
+
+import "expvar"
+
+// Publishes the server's connections to expvar, so that /debug/vars reports
+// them under the names prefix.connections, the number of open connections;
+// prefix.accepted_total, the number of connections accepted;
+// prefix.shutdown_in_progress, whether the server is draining; and
+// prefix.drain_duration_ms, how long the last drain took. The values are
+// read when /debug/vars is requested. Like expvar.Publish, it panics if a
+// name is already taken, so call it once per server with a prefix such as
+// "manners".
+func (s *GracefulServer) PublishExpvar(prefix string) {
+	s.init()
+	expvar.Publish(prefix+".connections", expvar.Func(func() interface{} {
+		return s.ConnectionCount()
+	}))
+	expvar.Publish(prefix+".accepted_total", expvar.Func(func() interface{} {
+		return s.AcceptedCount()
+	}))
+	expvar.Publish(prefix+".shutdown_in_progress", expvar.Func(func() interface{} {
+		return s.shutdownInProgress()
+	}))
+	expvar.Publish(prefix+".drain_duration_ms", expvar.Func(func() interface{} {
+		return s.DrainDuration().Milliseconds()
+	}))
+}
+
+// Reports whether Close or Drain has been called and the server hasn't
+// drained yet.
+func (s *GracefulServer) shutdownInProgress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closing && !s.draining {
+		return false
+	}
+	select {
+	case <-s.drained:
+		return false
+	default:
+		return true
+	}
+}
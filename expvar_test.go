@@ -0,0 +1,49 @@
+package manners
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Tests that PublishExpvar reports the open connections and the shutdown
+// as it progresses.
+func TestPublishExpvar(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	// expvar names can't be reused, so each run needs its own prefix.
+	prefix := fmt.Sprintf("manners_test_%p", server)
+	server.PublishExpvar(prefix)
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	value := func(name string) string {
+		return expvar.Get(prefix + "." + name).String()
+	}
+	if v := value("shutdown_in_progress"); v != "false" {
+		t.Fatalf("Expected no shutdown in progress, got %s", v)
+	}
+
+	go http.Get("http://" + addr)
+	<-ready
+	if v := value("connections"); v != "1" {
+		t.Fatalf("Expected 1 connection, got %s", v)
+	}
+	if v := value("accepted_total"); v != "1" {
+		t.Fatalf("Expected 1 connection accepted, got %s", v)
+	}
+	server.Close()
+	if v := value("shutdown_in_progress"); v != "true" {
+		t.Fatalf("Expected a shutdown in progress, got %s", v)
+	}
+
+	close(release)
+	<-exited
+	if v := value("shutdown_in_progress"); v != "false" {
+		t.Fatalf("Expected the shutdown to be over, got %s", v)
+	}
+	if v := value("connections"); v != "0" {
+		t.Fatalf("Expected no connections, got %s", v)
+	}
+}
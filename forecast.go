@@ -0,0 +1,106 @@
+package manners
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// An estimate of how a drain would go; see SimulateDrain.
+type DrainForecast struct {
+	// The connections open now.
+	Total int
+
+	// Those expected to finish, or to be closed as idle, before their
+	// timeout elapses.
+	Drained int
+
+	// Those expected to still be open when their timeout elapses, and so
+	// to be closed forcibly.
+	ForceClosed int
+
+	// The connections counted by ForceClosed that are in the middle of a
+	// request, or hijacked, and whose clients would be cut off; the others
+	// are idle.
+	ForceClosedActive int
+}
+
+// Estimates how a drain with the given ShutdownTimeout would go if it began
+// now, without closing anything, to help pick a timeout before a deploy.
+// The estimate goes by the state of every connection and, if CountBytes is
+// set, by when it was last used: an idle connection is expected to be
+// closed unless KeepIdleOnShutdown is set, or to time out if the inner
+// server's IdleTimeout is shorter than the timeout; a request is expected
+// to finish unless it has already been running, or the connection has
+// been quiet, for as long as the timeout; and a hijacked connection is
+// expected to stay open. DrainPolicy limits shorter than the timeout apply
+// to the connections in their state. It is a guess based on the past, not
+// a guarantee: a request can take any time to finish. A non-positive
+// timeout waits forever, so every connection is expected to drain.
+func (s *GracefulServer) SimulateDrain(timeout time.Duration) DrainForecast {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var f DrainForecast
+	count := func(tc *trackedConn) {
+		f.Total++
+		if s.wouldDrain(tc, timeout, now) {
+			f.Drained++
+			return
+		}
+		f.ForceClosed++
+		if tc.state == http.StateActive || tc.state == http.StateHijacked {
+			f.ForceClosedActive++
+		}
+	}
+	for _, tc := range s.conns {
+		count(tc)
+	}
+	for _, tc := range s.hijacked {
+		count(tc)
+	}
+	return f
+}
+
+// Reports whether tc is expected to be gone before a drain with the given
+// timeout closes it forcibly. Must be called with s.mu held.
+func (s *GracefulServer) wouldDrain(tc *trackedConn, timeout time.Duration, now time.Time) bool {
+	limit := timeout
+	var policy time.Duration
+	switch tc.state {
+	case http.StateActive:
+		policy = s.DrainPolicy.ActiveTimeout
+	case http.StateHijacked:
+		policy = s.DrainPolicy.HijackedTimeout
+	default:
+		policy = s.DrainPolicy.IdleTimeout
+	}
+	if policy > 0 && (limit <= 0 || policy < limit) {
+		limit = policy
+	}
+	if limit <= 0 || tc.disposable {
+		return true
+	}
+
+	switch tc.state {
+	case http.StateActive:
+		if c := tc.counter; c != nil {
+			last := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+			if now.Sub(last) >= limit {
+				return false
+			}
+		}
+		return now.Sub(tc.changed) < limit
+	case http.StateHijacked:
+		return false
+	default:
+		if !s.KeepIdleOnShutdown {
+			return true
+		}
+		idle := s.InnerServer.IdleTimeout
+		if idle <= 0 {
+			idle = s.InnerServer.ReadTimeout
+		}
+		return idle > 0 && idle-now.Sub(tc.changed) < limit
+	}
+}
@@ -0,0 +1,52 @@
+package manners
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSimulateDrain(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	server.ShutdownTimeout = 50 * time.Millisecond
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	active.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	waitFor(t, func() bool { return server.ConnectionCount() == 2 })
+
+	f := server.SimulateDrain(time.Hour)
+	if f != (DrainForecast{Total: 2, Drained: 1, ForceClosed: 1}) {
+		t.Fatalf("Expected the idle connection to be closed forcibly, got %+v", f)
+	}
+	time.Sleep(20 * time.Millisecond)
+	f = server.SimulateDrain(10 * time.Millisecond)
+	if f != (DrainForecast{Total: 2, ForceClosed: 2, ForceClosedActive: 1}) {
+		t.Fatalf("Expected the long request to be cut off as well, got %+v", f)
+	}
+	if f := server.SimulateDrain(0); f != (DrainForecast{Total: 2, Drained: 2}) {
+		t.Fatalf("Expected every connection to drain without a timeout, got %+v", f)
+	}
+	if n := server.ConnectionCount(); n != 2 {
+		t.Fatalf("Expected SimulateDrain to close nothing, %d connections are open", n)
+	}
+
+	server.Close()
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+package manners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A ServerGroup is a set of servers running in one process, such as a
+// public API, an internal API and a metrics endpoint, that are shut down
+// together.
+type ServerGroup []*GracefulServer
+
+// Closes the servers one after the other, in the order of the group: each
+// one is drained before the next one is closed. A server is given up to
+// timeoutEach to drain, after which its remaining connections are closed
+// forcibly; a non-positive timeoutEach waits forever. A server that was
+// never served is closed without waiting. Returns the errors from closing
+// the listeners and one for every server that didn't drain in time, joined
+// with errors.Join.
+func (g ServerGroup) CloseSequential(timeoutEach time.Duration) error {
+	var errs []error
+	for i, s := range g {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("manners: server %d: %w", i, err))
+		}
+		if !s.BlockingCloseWithTimeout(timeoutEach) {
+			errs = append(errs, fmt.Errorf("manners: server %d: connections closed forcibly after %v", i, timeoutEach))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Closes all the servers at once and waits for them to drain, like
+// ShutdownContext. Returns the errors from closing the listeners and
+// ctx.Err() for every server that hadn't drained when ctx was done, joined
+// with errors.Join. As with ShutdownContext, connections are not closed
+// when ctx expires, and a server that was never served isn't waited for.
+func (g ServerGroup) CloseParallel(ctx context.Context) error {
+	errs := make([]error, len(g))
+	var wg sync.WaitGroup
+	for i, s := range g {
+		wg.Add(1)
+		go func(i int, s *GracefulServer) {
+			defer wg.Done()
+			err := errors.Join(s.Close(), s.ShutdownContext(ctx))
+			if err != nil {
+				errs[i] = fmt.Errorf("manners: server %d: %w", i, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,93 @@
+package manners
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Tests that CloseSequential only closes a server once the one before it has
+// drained.
+func TestServerGroupCloseSequential(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	first, second := NewServer(), NewServer()
+	addr, firstExited := startServer(t, first, newWedgedHandler(ready, release))
+	_, secondExited := startServer(t, second, newTestHandler())
+
+	go http.Get("http://" + addr)
+	<-ready
+	closed := make(chan error, 1)
+	go func() {
+		closed <- ServerGroup{first, second}.CloseSequential(0)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if second.IsDraining() {
+		t.Fatal("The second server was closed before the first one drained")
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for _, exited := range []chan error{firstExited, secondExited} {
+		if err := <-exited; err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Tests that CloseParallel closes every server at once and reports the ones
+// that didn't drain before the context expired.
+func TestServerGroupCloseParallel(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	busy, idle := NewServer(), NewServer()
+	addr, _ := startServer(t, busy, newWedgedHandler(ready, release))
+	_, idleExited := startServer(t, idle, newTestHandler())
+
+	go http.Get("http://" + addr)
+	<-ready
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ServerGroup{busy, idle}.CloseParallel(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the busy server to miss the deadline, got %v", err)
+	}
+	if err := <-idleExited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if !busy.IsDraining() {
+		t.Fatal("Expected the busy server to be draining")
+	}
+}
+
+// Tests that a server in the group that was never served doesn't hold up
+// the others being closed.
+func TestServerGroupCloseNeverServed(t *testing.T) {
+	for _, closeGroup := range []func(ServerGroup) error{
+		func(g ServerGroup) error { return g.CloseSequential(0) },
+		func(g ServerGroup) error { return g.CloseParallel(context.Background()) },
+	} {
+		unused, served := NewServer(), NewServer()
+		_, exited := startServer(t, served, newTestHandler())
+		closed := make(chan error, 1)
+		go func() {
+			closed <- closeGroup(ServerGroup{unused, served})
+		}()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Closing the group blocked on the server that was never served")
+		}
+		if err := <-exited; err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	}
+}
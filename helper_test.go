@@ -1,7 +1,23 @@
 package manners
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
 	"time"
 )
 
@@ -32,3 +48,154 @@ func newTestHandler() testHandler {
 type testHandler struct{}
 
 func (h testHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {}
+
+// A response handler that signals when a request arrives and then blocks
+// until it is released; simulates a handler wedged on a downstream call.
+func newWedgedHandler(ready, release chan bool) *wedgedHandler {
+	return &wedgedHandler{ready, release}
+}
+
+type wedgedHandler struct {
+	ready   chan bool
+	release chan bool
+}
+
+func (h *wedgedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	h.ready <- true
+	<-h.release
+}
+
+// Starts serving on an ephemeral localhost port. Returns the address that
+// was bound and a channel that receives the return value of Serve.
+func startServer(t *testing.T, server *GracefulServer, handler http.Handler) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(NewListener(l, server), handler)
+	}()
+	return l.Addr().String(), exited
+}
+
+// Writes a self-signed certificate for 127.0.0.1 and its key to a temporary
+// directory and returns their paths.
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"manners"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// Returns a client that trusts any certificate and speaks HTTP/2.
+func newTLSClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+// Like http.Get, but retries for a while if the server isn't listening yet.
+func getWhenListening(url string) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for i := 0; i < 100; i++ {
+		if resp, err = http.Get(url); !errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return resp, err
+}
+
+// Makes a request to url with a client of its own, and returns its error.
+func getErr(url string) error {
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// A Logger that records the messages it receives.
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *testLogger) Messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.messages...)
+}
+
+// A response handler that hijacks the connection and hands it over.
+func newHijackingHandler(conns chan net.Conn) *hijackingHandler {
+	return &hijackingHandler{conns}
+}
+
+type hijackingHandler struct {
+	conns chan net.Conn
+}
+
+func (h *hijackingHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	conn, _, err := resp.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	h.conns <- conn
+}
+
+// Waits up to five seconds for cond to hold.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
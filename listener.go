@@ -1,14 +1,91 @@
 package manners
 
 import (
+	"context"
+	"errors"
 	"net"
+	"os"
 	"sync"
+	"time"
+)
+
+// How long Accept waits before retrying after the underlying listener
+// panicked; see RecoverAccept.
+const recoverAcceptDelay = 5 * time.Millisecond
+
+// The bounds of the delay before Accept is retried after a temporary error.
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
 )
 
 func NewListener(l net.Listener, s *GracefulServer) *GracefulListener {
-	return &GracefulListener{l, true, s, sync.RWMutex{}}
+	if s != nil {
+		s.init()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GracefulListener{Listener: l, open: true, server: s, closed: ctx, close: cancel}
+}
+
+// Creates a GracefulListener from a listening socket inherited from another
+// process, typically one that obtained it from File before exec'ing this
+// one. The file is duplicated, so the caller may close f afterwards.
+func NewListenerFromFile(f *os.File, s *GracefulServer) (*GracefulListener, error) {
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, s), nil
+}
+
+// Creates a GracefulListener for s that accepts the connections sent on the
+// returned channel, such as one end of a net.Pipe, for driving a server in
+// memory in tests or in-process transports. The server's settings, such as
+// MaxConnections and ConnWrapper, apply to the connections as they do to
+// those of any other listener, except for the TCP options. A send blocks
+// until the connection is accepted, and forever once the listener is
+// closed, unless Undrain opens it again, so a sender that may outlive it
+// should select on the send.
+// Accept also fails once the channel is closed.
+func NewChanListener(s *GracefulServer) (*GracefulListener, chan<- net.Conn) {
+	l := &chanListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	return NewListener(l, s), l.conns
+}
+
+// A chanListener accepts connections from a channel.
+type chanListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-l.conns:
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
 }
 
+func (l *chanListener) Addr() net.Addr {
+	return chanAddr{}
+}
+
+// The address of every chanListener.
+type chanAddr struct{}
+
+func (chanAddr) Network() string { return "chan" }
+func (chanAddr) String() string  { return "chan" }
+
 // A GracefulListener differs from a standard net.Listener in one way: if
 // Accept() is called after it is gracefully closed, it returns a
 // listenerAlreadyClosed error. The GracefulServer will ignore this
@@ -18,11 +95,35 @@ type GracefulListener struct {
 	open   bool
 	server *GracefulServer
 	rw     sync.RWMutex
+
+	// Done once the listener is closed, to end a wait for the
+	// AcceptLimiter.
+	closed context.Context
+	close  context.CancelFunc
 }
 
 func (l *GracefulListener) Accept() (net.Conn, error) {
-	conn, err := l.Listener.Accept()
+	var slot bool
+	if l.server != nil {
+		var ok bool
+		if slot, ok = l.server.waitForCapacity(l); !ok {
+			return nil, listenerAlreadyClosed{errListenerClosed}
+		}
+	}
+	if l.server != nil && l.server.AcceptLimiter != nil {
+		if err := l.server.AcceptLimiter.Wait(l.closed); err != nil {
+			l.server.releaseSlot(slot)
+			if !l.isOpen() {
+				return nil, listenerAlreadyClosed{err}
+			}
+			return nil, err
+		}
+	}
+	conn, ip, err := l.acceptAdmitted()
 	if err != nil {
+		if l.server != nil {
+			l.server.releaseSlot(slot)
+		}
 		l.rw.RLock()
 		defer l.rw.RUnlock()
 		if !l.open {
@@ -30,20 +131,180 @@ func (l *GracefulListener) Accept() (net.Conn, error) {
 		}
 		return nil, err
 	}
+	if !l.isOpen() {
+		// Close won the race with this connection. Turn it away rather
+		// than let it into a drain that may already be under way.
+		conn.Close()
+		if l.server != nil {
+			l.server.releaseIP(ip)
+			l.server.releaseSlot(slot)
+		}
+		return nil, listenerAlreadyClosed{errListenerClosed}
+	}
+	if l.server != nil {
+		l.server.setTCPOptions(conn)
+		if l.server.HandshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(l.server.HandshakeTimeout))
+		}
+	}
+	if l.server != nil && l.server.tracksConns() && l.server.CountBytes {
+		conn = newMeteredConn(conn)
+	}
+	if l.server != nil && l.server.ProxyProtocol {
+		pc := newProxyConn(conn)
+		if l.server.MaxConnectionsPerIP > 0 && l.server.tracksConns() {
+			pc.admit = l.server.admitProxied
+		}
+		conn = pc
+	}
+	if l.server != nil && l.server.tracksConns() && l.server.TrackHijacked {
+		conn = &gracefulConn{Conn: conn, server: l.server}
+	}
+	if l.server != nil && l.server.ConnWrapper != nil {
+		conn = l.server.ConnWrapper(conn)
+	}
+	if l.server != nil {
+		l.server.holdIP(conn, ip)
+		l.server.holdSlot(conn, slot)
+	}
 	return conn, nil
 }
 
+// Accepts a connection, closing those from client addresses already at
+// MaxConnectionsPerIP. Returns the address the connection has reserved a
+// slot for; see admitIP.
+func (l *GracefulListener) acceptAdmitted() (net.Conn, string, error) {
+	for {
+		conn, err := l.acceptRetrying()
+		if err != nil || l.server == nil {
+			return conn, "", err
+		}
+		if ip, ok := l.server.admitIP(conn.RemoteAddr()); ok {
+			return conn, ip, nil
+		}
+		l.server.logf("manners: turning away a connection from %s, which has %d open already", clientIP(conn.RemoteAddr()), l.server.MaxConnectionsPerIP)
+		conn.Close()
+	}
+}
+
+// Accepts a connection, retrying with a growing delay after a temporary
+// error such as running out of file descriptors, as http.Server does. A
+// faulty listener returning neither a connection nor an error is retried
+// the same way, rather than the nil connection being served.
+func (l *GracefulListener) acceptRetrying() (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.accept()
+		if conn == nil && err == nil {
+			err = nilConnError{}
+		}
+		ne, ok := err.(net.Error)
+		if err == nil || !ok || !ne.Temporary() || !l.isOpen() {
+			return conn, err
+		}
+		if delay == 0 {
+			delay = minAcceptRetryDelay
+		} else {
+			delay *= 2
+		}
+		if delay > maxAcceptRetryDelay {
+			delay = maxAcceptRetryDelay
+		}
+		if l.server != nil {
+			l.server.logf("manners: error accepting connection: %v; retrying in %v", err, delay)
+			if l.server.AcceptError != nil {
+				l.server.AcceptError(err)
+			}
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Accepts a connection from the underlying listener, retrying after a panic
+// if the server has RecoverAccept set.
+func (l *GracefulListener) accept() (net.Conn, error) {
+	if l.server == nil || !l.server.RecoverAccept {
+		return l.Listener.Accept()
+	}
+	for {
+		conn, panicked, err := l.tryAccept()
+		if !panicked {
+			return conn, err
+		}
+		if !l.isOpen() {
+			return nil, errListenerClosed
+		}
+		// Don't spin if the listener panics on every call.
+		time.Sleep(recoverAcceptDelay)
+	}
+}
+
+func (l *GracefulListener) tryAccept() (conn net.Conn, panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			l.server.logf("manners: recovered from panic in Accept: %v", r)
+			panicked = true
+		}
+	}()
+	conn, err = l.Listener.Accept()
+	return conn, false, err
+}
+
 func (l *GracefulListener) Close() error {
 	l.rw.Lock()
-	defer l.rw.Unlock()
 	if !l.open {
+		l.rw.Unlock()
 		return nil
 	}
 	l.open = false
 	err := l.Listener.Close()
+	l.rw.Unlock()
+	l.close()
+
+	// The server checks whether the listener is open while holding its own
+	// lock, so it must be woken up after releasing ours.
+	if l.server != nil {
+		l.server.listenerClosed()
+	}
 	return err
 }
 
+func (l *GracefulListener) isOpen() bool {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	return l.open
+}
+
+// Returns a duplicate of the listening socket's file descriptor so that it
+// can be handed to another process, which resumes accepting on it with
+// NewListenerFromFile. This process can then be closed to drain its own
+// connections. File must be called before Close; closing the listener
+// doesn't affect the duplicate.
+func (l *GracefulListener) File() (*os.File, error) {
+	l.rw.RLock()
+	defer l.rw.RUnlock()
+	if !l.open {
+		return nil, errors.New("manners: listener is closed")
+	}
+	fl, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, errors.New("manners: listener has no file descriptor")
+	}
+	return fl.File()
+}
+
+var errListenerClosed = errors.New("manners: listener closed")
+
 type listenerAlreadyClosed struct {
 	error
 }
+
+// The temporary error standing in for a nil connection returned by the
+// underlying listener without an error.
+type nilConnError struct{}
+
+func (nilConnError) Error() string   { return "manners: listener returned a nil connection" }
+func (nilConnError) Timeout() bool   { return false }
+func (nilConnError) Temporary() bool { return true }
@@ -0,0 +1,203 @@
+package manners
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Returns the keep-alive settings of a TCP connection.
+func keepAlive(t *testing.T, conn net.Conn) (enabled bool, idle time.Duration) {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var on, secs int
+	raw.Control(func(fd uintptr) {
+		on, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+		if err == nil {
+			secs, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return on != 0, time.Duration(secs) * time.Second
+}
+
+// Tests that the GracefulListener applies KeepAlivePeriod to TCP
+// connections.
+func TestKeepAlivePeriod(t *testing.T) {
+	for _, period := range []time.Duration{time.Minute, -1} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewServer()
+		server.KeepAlivePeriod = period
+		listener := NewListener(l, server)
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enabled, idle := keepAlive(t, conn)
+		if period > 0 && (!enabled || idle != period) {
+			t.Errorf("Expected a keep-alive period of %v, got %v (enabled %v)", period, idle, enabled)
+		}
+		if period < 0 && enabled {
+			t.Error("Expected keep-alives to be off")
+		}
+		conn.Close()
+		client.Close()
+		listener.Close()
+	}
+}
+
+// Tests that the GracefulListener applies TCPNoDelay to TCP connections.
+func TestTCPNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewServer()
+		server.TCPNoDelay = &noDelay
+		listener := NewListener(l, server)
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var on int
+		raw.Control(func(fd uintptr) {
+			on, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (on != 0) != noDelay {
+			t.Errorf("Expected TCP_NODELAY to be %v", noDelay)
+		}
+		conn.Close()
+		client.Close()
+		listener.Close()
+	}
+}
+
+// Tests that a second server can bind the address of one that is still
+// listening, as a new process does during a restart.
+func TestListenReusePort(t *testing.T) {
+	old := NewServer()
+	l, err := ListenReusePort(old, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	replacement := NewServer()
+	l2, err := ListenReusePort(replacement, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- replacement.Serve(l2, newTestHandler())
+	}()
+	l.Close()
+
+	resp, err := http.Get("http://" + l2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	replacement.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ServeWithOptions applies the TCP options to the connections
+// accepted from a plain listener.
+func TestServeWithOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.KeepAlivePeriod = time.Minute
+	accepted := make(chan net.Conn, 1)
+	server.StateChanged = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			accepted <- conn
+		}
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ServeWithOptions(l, newTestHandler())
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if enabled, idle := keepAlive(t, <-accepted); !enabled || idle != time.Minute {
+		t.Errorf("Expected a keep-alive period of %v, got %v (enabled %v)", time.Minute, idle, enabled)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ForceCloseWithReset has a connection closed forcibly reset,
+// and that it is closed normally otherwise.
+func TestForceCloseWithReset(t *testing.T) {
+	for _, reset := range []bool{false, true} {
+		ready := make(chan bool)
+		release := make(chan bool)
+		server := NewServer()
+		server.ShutdownTimeout = 50 * time.Millisecond
+		server.ForceCloseWithReset = reset
+		addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+		<-ready
+		server.Close()
+		<-exited
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+		close(release)
+		if reset && !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("Expected the connection to be reset, got %v", err)
+		}
+		if !reset && err != io.EOF {
+			t.Fatalf("Expected the connection to be closed normally, got %v", err)
+		}
+	}
+}
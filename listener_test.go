@@ -0,0 +1,484 @@
+package manners
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that a listener handed over through File keeps accepting connections
+// in its new owner after the original listener is closed.
+func TestListenerFile(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := NewServer()
+	listener := NewListener(l, parent)
+	f, err := listener.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	if _, err := listener.File(); err == nil {
+		t.Fatal("Expected an error calling File on a closed listener")
+	}
+
+	child := NewServer()
+	inherited, err := NewListenerFromFile(f, child)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- child.Serve(inherited, newTestHandler())
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	child.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A listener whose Accept panics a given number of times before it starts
+// working.
+type panickingListener struct {
+	net.Listener
+	panics int32
+}
+
+func (l *panickingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.panics, -1) >= 0 {
+		panic("accept exploded")
+	}
+	return l.Listener.Accept()
+}
+
+// Tests that a panic in the underlying Accept is recovered from and logged
+// when RecoverAccept is set, and that the server still closes normally.
+func TestRecoverAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &testLogger{}
+	server := NewServer()
+	server.RecoverAccept = true
+	server.Logger = logger
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(NewListener(&panickingListener{l, 2}, server), newTestHandler())
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	recovered := 0
+	for _, m := range logger.Messages() {
+		if strings.Contains(m, "accept exploded") {
+			recovered++
+		}
+	}
+	if recovered != 2 {
+		t.Fatalf("Expected 2 recovered panics to be logged, got %d", recovered)
+	}
+}
+
+// A ConnWrapper that counts the bytes read from the connection.
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Tests that ConnWrapper is applied to accepted connections, and that a
+// hijacked connection it wrapped is still tracked.
+func TestConnWrapper(t *testing.T) {
+	var read int64
+	conns := make(chan net.Conn, 1)
+	server := NewServer()
+	server.TrackHijacked = true
+	server.ConnWrapper = func(conn net.Conn) net.Conn {
+		return &countingConn{conn, &read}
+	}
+	addr, exited := startServer(t, server, newHijackingHandler(conns))
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	hijacked := <-conns
+
+	if _, ok := hijacked.(*countingConn); !ok {
+		t.Fatalf("Expected the handler to get the wrapped connection, got %T", hijacked)
+	}
+	if atomic.LoadInt64(&read) == 0 {
+		t.Fatal("Expected the request to be read through the wrapper")
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected the hijacked connection to be tracked, got %d connections", n)
+	}
+	server.Close()
+	hijacked.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A temporary error, as returned by Accept when the process runs out of
+// file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// A listener whose Accept fails with a temporary error a given number of
+// times before it starts working.
+type failingListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+// Tests that temporary Accept errors are reported through AcceptError and
+// retried rather than ending Serve.
+func TestAcceptError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported int32
+	server := NewServer()
+	server.AcceptError = func(err error) {
+		if _, ok := err.(temporaryError); !ok {
+			t.Errorf("Unexpected error %v", err)
+		}
+		atomic.AddInt32(&reported, 1)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(NewListener(&failingListener{l, 2}, server), newTestHandler())
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&reported); n != 2 {
+		t.Fatalf("Expected 2 errors reported, got %d", n)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A listener whose Accept returns neither a connection nor an error a given
+// number of times before it starts working.
+type nilConnListener struct {
+	net.Listener
+	nils int32
+}
+
+func (l *nilConnListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.nils, -1) >= 0 {
+		return nil, nil
+	}
+	return l.Listener.Accept()
+}
+
+// Tests that a nil connection returned without an error is retried rather
+// than served.
+func TestAcceptNilConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	var reported int32
+	server.AcceptError = func(err error) {
+		if _, ok := err.(nilConnError); !ok {
+			t.Errorf("Unexpected error %v", err)
+		}
+		atomic.AddInt32(&reported, 1)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(NewListener(&nilConnListener{l, 2}, server), newTestHandler())
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&reported); n != 2 {
+		t.Fatalf("Expected 2 nil connections reported, got %d", n)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A listener whose Accept keeps failing with a permanent error, counting how
+// often it is called.
+type brokenListener struct {
+	net.Listener
+	calls int32
+}
+
+func (l *brokenListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&l.calls, 1)
+	return nil, errors.New("broken")
+}
+
+// Tests that a permanent Accept error ends Serve after a single call rather
+// than being retried.
+func TestAcceptPermanentError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	broken := &brokenListener{Listener: l}
+	server := NewServer()
+	err = server.Serve(NewListener(broken, server), newTestHandler())
+	if err == nil || err.Error() != "broken" {
+		t.Fatalf("Expected the listener's error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&broken.calls); n != 1 {
+		t.Fatalf("Expected Accept to be called once, got %d", n)
+	}
+}
+
+// Tests that the delay between retries of temporary Accept errors doubles
+// from minAcceptRetryDelay.
+func TestAcceptBackoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	var failures []time.Time
+	server.AcceptError = func(error) { failures = append(failures, time.Now()) }
+	listener := NewListener(&failingListener{l, 4}, server)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if len(failures) != 4 {
+		t.Fatalf("Expected 4 errors reported, got %d", len(failures))
+	}
+	delay := minAcceptRetryDelay
+	for i := 1; i < len(failures); i++ {
+		if gap := failures[i].Sub(failures[i-1]); gap < delay {
+			t.Errorf("Retry %d came after %v, expected at least %v", i, gap, delay)
+		}
+		delay *= 2
+	}
+}
+
+var errShutDown = errors.New("shut down")
+
+// A listener that reports having been closed with an error of its own.
+type shutDownListener struct {
+	net.Listener
+}
+
+func (l shutDownListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, errShutDown
+	}
+	return conn, nil
+}
+
+// Tests that IsClosedErr lets Serve recognize a listener closed behind the
+// server's back as having been closed on purpose.
+func TestIsClosedErr(t *testing.T) {
+	for _, recognized := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := NewServer()
+		if recognized {
+			server.IsClosedErr = func(err error) bool { return err == errShutDown }
+		}
+		exited := make(chan error, 1)
+		go func() {
+			exited <- server.Serve(NewListener(shutDownListener{l}, server), newTestHandler())
+		}()
+		<-server.Listening()
+		l.Close()
+
+		err = <-exited
+		if recognized && err != ErrServerClosed {
+			t.Fatalf("Expected ErrServerClosed, got %v", err)
+		}
+		if !recognized && err != errShutDown {
+			t.Fatalf("Expected the listener's error, got %v", err)
+		}
+	}
+}
+
+// Tests that closing a server serving a listener other than a
+// GracefulListener ends Serve cleanly.
+func TestServePlainListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(l, newTestHandler())
+	}()
+	<-server.Listening()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+// A Limiter that lets a number of operations through and then blocks.
+type gateLimiter struct {
+	allowed int32
+	waits   int32
+}
+
+func (l *gateLimiter) Wait(ctx context.Context) error {
+	if atomic.AddInt32(&l.waits, 1) <= l.allowed {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Tests that Accept waits for the AcceptLimiter before accepting each
+// connection, and that closing the server ends the wait.
+func TestAcceptLimiter(t *testing.T) {
+	server := NewServer()
+	limiter := &gateLimiter{allowed: 1}
+	server.AcceptLimiter = limiter
+	addr, exited := startServer(t, server, newTestHandler())
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitFor(t, func() bool { return atomic.LoadInt32(&limiter.waits) == 2 })
+
+	// The second connection waits in the backlog.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadUint64(&server.acceptedCount); n != 1 {
+		t.Fatalf("Expected 1 connection accepted, got %d", n)
+	}
+
+	server.Close()
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not end the wait for the limiter")
+	}
+}
+
+func TestChanListener(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	var wrapped int32
+	server.ConnWrapper = func(conn net.Conn) net.Conn {
+		atomic.AddInt32(&wrapped, 1)
+		return conn
+	}
+	l, conns := NewChanListener(server)
+	exited := make(chan error, 1)
+	go func() { exited <- server.Serve(l, newWedgedHandler(ready, release)) }()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	conns <- conn
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-ready
+	if n := atomic.LoadInt32(&wrapped); n != 1 {
+		t.Fatalf("Expected the server's ConnWrapper to wrap the connection, called %d times", n)
+	}
+
+	server.Close()
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected Serve to wait for the request, it returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := l.Accept(); !errors.As(err, new(listenerAlreadyClosed)) {
+		t.Fatalf("Expected listenerAlreadyClosed from Accept, got %v", err)
+	}
+}
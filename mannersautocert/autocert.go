@@ -0,0 +1,33 @@
+// Package mannersautocert serves a GracefulServer over TLS with certificates
+// obtained from Let's Encrypt. It is a package of its own so that only the
+// programs that import it depend on golang.org/x/crypto.
+package mannersautocert
+
+import (
+	"net/http"
+
+	"github.com/braintree/manners"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Returns an autocert.Manager that obtains certificates from Let's Encrypt
+// for the given domains and no others, caching them in cacheDir. Let's
+// Encrypt validates the domains over HTTP on port 80, so serve the manager's
+// HTTPHandler there, for instance on a second GracefulServer.
+func NewManager(cacheDir string, domains ...string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+}
+
+// Like s.ListenAndServeTLS, but with certificates obtained and renewed by m.
+// The server drains on shutdown exactly as it does with ListenAndServeTLS.
+// It takes the manager, from NewManager or built by hand, rather than the
+// domains, so that the caller can serve its HTTPHandler on port 80 and share
+// it between servers; and it takes the handler like the ListenAndServe
+// methods of the server.
+func ListenAndServe(s *manners.GracefulServer, addr string, m *autocert.Manager, handler http.Handler) error {
+	return s.ListenAndServeTLSConfig(addr, m.TLSConfig(), handler)
+}
@@ -0,0 +1,75 @@
+package mannersautocert
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/braintree/manners"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Tests that the manager only obtains certificates for the given domains,
+// and caches them in the given directory.
+func TestNewManager(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(dir, "example.com", "www.example.com")
+	for _, host := range []string{"example.com", "www.example.com"} {
+		if err := m.HostPolicy(context.Background(), host); err != nil {
+			t.Fatalf("Expected %s to be allowed, got %v", host, err)
+		}
+	}
+	if err := m.HostPolicy(context.Background(), "other.example"); err == nil {
+		t.Fatal("Expected other.example to be refused")
+	}
+	if cache, ok := m.Cache.(autocert.DirCache); !ok || string(cache) != dir {
+		t.Fatalf("Expected the certificates to be cached in %s, got %v", dir, m.Cache)
+	}
+}
+
+// Tests that ListenAndServe refuses the handshake for a domain it was not
+// given, without asking Let's Encrypt, and returns ErrServerClosed once the
+// server is closed.
+func TestListenAndServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := manners.NewServer()
+	m := NewManager(t.TempDir(), "example.com")
+	exited := make(chan error, 1)
+	go func() {
+		exited <- ListenAndServe(server, addr, m, http.NotFoundHandler())
+	}()
+
+	var conn *tls.Conn
+	for i := 0; i < 100; i++ {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, &tls.Config{
+			ServerName: "other.example",
+		})
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected the handshake for other.example to fail")
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal(err)
+	}
+
+	server.Close()
+	if err := <-exited; err != manners.ErrServerClosed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,50 @@
+// Package mannersprometheus exports the connections of a GracefulServer to
+// Prometheus. It is a package of its own so that only the programs that
+// import it depend on the Prometheus client.
+package mannersprometheus
+
+import (
+	"github.com/braintree/manners"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Returns a collector that exports the server's connections to Prometheus:
+// a gauge of the open connections in each state, and counters of the
+// connections accepted and of those that finished during a shutdown.
+// Register it once per server.
+func NewCollector(s *manners.GracefulServer) prometheus.Collector {
+	return &connCollector{
+		server: s,
+		conns: prometheus.NewDesc("manners_connections",
+			"Open connections by state.", []string{"state"}, nil),
+		accepted: prometheus.NewDesc("manners_connections_accepted_total",
+			"Connections accepted.", nil, nil),
+		drained: prometheus.NewDesc("manners_connections_drained_total",
+			"Connections that finished after shutdown began.", nil, nil),
+	}
+}
+
+type connCollector struct {
+	server   *manners.GracefulServer
+	conns    *prometheus.Desc
+	accepted *prometheus.Desc
+	drained  *prometheus.Desc
+}
+
+func (c *connCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.conns
+	ch <- c.accepted
+	ch <- c.drained
+}
+
+// The connection states are read when Prometheus scrapes, not as
+// connections change state, so serving pays nothing for the metrics.
+func (c *connCollector) Collect(ch chan<- prometheus.Metric) {
+	for state, n := range c.server.ConnectionStates() {
+		ch <- prometheus.MustNewConstMetric(c.conns, prometheus.GaugeValue, float64(n), state.String())
+	}
+	ch <- prometheus.MustNewConstMetric(c.accepted, prometheus.CounterValue,
+		float64(c.server.AcceptedCount()))
+	ch <- prometheus.MustNewConstMetric(c.drained, prometheus.CounterValue,
+		float64(c.server.DrainedCount()))
+}
@@ -0,0 +1,72 @@
+package mannersprometheus
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/braintree/manners/mannerstest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tests that the collector reports a connection while it is open, and the
+// totals once it has been accepted and drained.
+func TestCollector(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	ts := mannerstest.NewTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready <- true
+		<-release
+	}))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(ts.Server))
+
+	// Returns the value of the metric named name, and for
+	// manners_connections, of the one for state.
+	value := func(name, state string) float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				if m.GetCounter() != nil {
+					return m.GetCounter().GetValue()
+				}
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "state" && label.GetValue() == state {
+						return m.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		t.Fatalf("No metric %s %s", name, state)
+		return 0
+	}
+
+	go http.Get(ts.URL)
+	<-ready
+	if v := value("manners_connections", "active"); v != 1 {
+		t.Fatalf("Expected 1 active connection, got %v", v)
+	}
+	if v := value("manners_connections_accepted_total", ""); v != 1 {
+		t.Fatalf("Expected 1 connection accepted, got %v", v)
+	}
+	if v := value("manners_connections_drained_total", ""); v != 0 {
+		t.Fatalf("Expected no connection drained before Close, got %v", v)
+	}
+
+	ts.Server.Close()
+	close(release)
+	if !ts.Shutdown(0) {
+		t.Fatal("Expected the server to drain cleanly")
+	}
+	if v := value("manners_connections", "active"); v != 0 {
+		t.Fatalf("Expected no active connection, got %v", v)
+	}
+	if v := value("manners_connections_drained_total", ""); v != 1 {
+		t.Fatalf("Expected 1 connection drained, got %v", v)
+	}
+}
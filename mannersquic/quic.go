@@ -0,0 +1,191 @@
+// Package mannersquic serves HTTP/3 with the drain discipline of manners.
+// It is a package of its own so that only the programs that import it
+// depend on quic-go.
+package mannersquic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/braintree/manners"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// How long a drained Server waits for clients to hang up before closing
+// their connections. A handler returns before quic-go has sent its
+// response, so closing at once could cut the last responses off.
+const quicFlushGrace = time.Second
+
+// A Server serves HTTP/3 with the drain discipline of a
+// manners.GracefulServer: Close stops it accepting requests, and Serve
+// returns once the requests in flight have finished. QUIC multiplexes
+// requests on a connection much like HTTP/2, so it counts requests rather
+// than connections.
+type Server struct {
+	// The server that handles the requests. Handler is overwritten by
+	// Serve.
+	InnerServer http3.Server
+
+	// How long to wait for in-flight requests once shutdown has begun.
+	// Requests still running when it elapses are cut off. Zero means wait
+	// forever.
+	ShutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	active   int
+	forced   bool
+	closeErr error
+	quiet    chan struct{}
+	closed   chan struct{}
+	drained  chan struct{}
+
+	closeOnce sync.Once
+}
+
+// Creates a new Server.
+func NewServer() *Server {
+	return &Server{
+		closed:  make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+}
+
+// Like manners.GracefulServer.ListenAndServeTLS, but over QUIC on a UDP port.
+func (s *Server) ListenAndServe(addr, certFile, keyFile string, handler http.Handler) error {
+	s.InnerServer.Addr = addr
+	return s.serve(handler, func() error {
+		return s.InnerServer.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+// Serves HTTP/3 on conn until the server is closed and drained, then
+// returns manners.ErrServerClosed. InnerServer.TLSConfig must be set.
+func (s *Server) Serve(conn net.PacketConn, handler http.Handler) error {
+	return s.serve(handler, func() error {
+		return s.InnerServer.Serve(conn)
+	})
+}
+
+func (s *Server) serve(handler http.Handler, serve func() error) error {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	s.InnerServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.active++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.active--
+			if s.active == 0 && s.quiet != nil {
+				select {
+				case <-s.quiet:
+				default:
+					close(s.quiet)
+				}
+			}
+			s.mu.Unlock()
+		}()
+		handler.ServeHTTP(w, r)
+	})
+
+	err := serve()
+	select {
+	case <-s.closed:
+	default:
+		// The server failed rather than being closed.
+		return err
+	}
+	<-s.drained
+	return manners.ErrServerClosed
+}
+
+// Shuts the server down: each client is sent a GOAWAY so that it opens no
+// new requests, and the HTTP/3 server is closed once the requests in flight
+// have finished or ShutdownTimeout has elapsed. Unlike GracefulServer.Close
+// it waits for that, since the HTTP/3 server only closes its listeners then.
+// Returns the error from closing it to the call that started the shutdown;
+// later calls wait as well and return nil. It is safe to call more than
+// once.
+func (s *Server) Close() error {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		close(s.closed)
+		go s.shutdown()
+	})
+	<-s.drained
+	if !first {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeErr
+}
+
+// Closes the server and waits for the in-flight requests to finish, or for
+// ShutdownTimeout to elapse. Returns true if the server drained cleanly.
+func (s *Server) BlockingClose() bool {
+	s.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.forced
+}
+
+// Returns the number of requests in flight.
+func (s *Server) ConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *Server) shutdown() {
+	ctx := context.Background()
+	if s.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ShutdownTimeout)
+		defer cancel()
+	}
+	s.mu.Lock()
+	s.quiet = make(chan struct{})
+	if s.active == 0 {
+		close(s.quiet)
+	}
+	quiet := s.quiet
+	s.mu.Unlock()
+
+	// Shutdown sends the GOAWAYs, but then waits for every client to hang
+	// up, which a client is free not to do; so the drain is judged by the
+	// requests in flight, and Shutdown is cut short once they are done and
+	// their responses have had quicFlushGrace to reach the clients.
+	shutdownCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	shutdownDone := make(chan struct{})
+	go func() {
+		s.InnerServer.Shutdown(shutdownCtx)
+		close(shutdownDone)
+	}()
+	select {
+	case <-quiet:
+		select {
+		case <-shutdownDone:
+		case <-ctx.Done():
+		case <-time.After(quicFlushGrace):
+		}
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.forced = true
+		s.mu.Unlock()
+	}
+	cancel()
+	<-shutdownDone
+	// Cuts off whatever outlived the timeout.
+	err := s.InnerServer.Close()
+	s.mu.Lock()
+	s.closeErr = err
+	s.mu.Unlock()
+	close(s.drained)
+}
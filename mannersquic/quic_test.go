@@ -0,0 +1,121 @@
+package mannersquic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/braintree/manners"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Tests that Serve and Close wait for a request that is in flight when the
+// server is closed, and that the request completes.
+func TestDrainsRequest(t *testing.T) {
+	cert := newTestCert(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.InnerServer.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(conn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ready <- true
+			<-release
+		}))
+	}()
+
+	transport := &http3.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	responded := make(chan error, 1)
+	go func() {
+		resp, err := client.Get("https://" + conn.LocalAddr().String())
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = errBadStatus(resp.StatusCode)
+			}
+		}
+		responded <- err
+	}()
+	<-ready
+
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 request in flight, got %d", n)
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- server.Close()
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the request finished")
+	case err := <-exited:
+		t.Fatalf("Serve returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-responded; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if !server.BlockingClose() {
+		t.Fatal("Expected the server to drain cleanly")
+	}
+	if err := <-exited; err != manners.ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected no request in flight, got %d", n)
+	}
+}
+
+type errBadStatus int
+
+func (e errBadStatus) Error() string {
+	return http.StatusText(int(e))
+}
+
+// Returns a self-signed certificate for 127.0.0.1.
+func newTestCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"manners"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
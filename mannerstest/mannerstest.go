@@ -0,0 +1,69 @@
+// Package mannerstest runs GracefulServers for tests, in the manner of
+// net/http/httptest, so that handlers and shutdown hooks can be tested
+// against a real drain.
+package mannerstest
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/braintree/manners"
+)
+
+// A TestServer is a GracefulServer serving on an ephemeral port of the
+// loopback interface.
+type TestServer struct {
+	// The base URL of the server, of the form http://127.0.0.1:port.
+	URL string
+
+	// The server itself, for instance to call IsDraining or
+	// ConnectionStats on.
+	Server *manners.GracefulServer
+
+	// Closed once Serve has returned.
+	exited chan struct{}
+}
+
+// Starts a server with handler, configured by opts. It panics if it can't
+// listen, as httptest.NewServer does.
+func NewTestServer(handler http.Handler, opts ...manners.Option) *TestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mannerstest: failed to listen: %v", err))
+	}
+	ts := &TestServer{
+		URL:    "http://" + l.Addr().String(),
+		Server: manners.NewServer(opts...),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		defer close(ts.exited)
+		ts.Server.ServeWithOptions(l, handler)
+	}()
+	<-ts.Server.Listening()
+	return ts
+}
+
+// Closes the server, waits up to timeout for it to drain and then for
+// Serve to return. Connections still open after the timeout are closed
+// forcibly; a non-positive timeout waits forever. Returns true if the
+// server drained cleanly. It may be called more than once.
+func (ts *TestServer) Shutdown(timeout time.Duration) bool {
+	drained := ts.Server.BlockingCloseWithTimeout(timeout)
+	<-ts.exited
+	return drained
+}
+
+// Returns the number of connections that finished gracefully during the
+// shutdown.
+func (ts *TestServer) DrainedCount() int {
+	return ts.Server.DrainedCount()
+}
+
+// Returns the number of connections that were closed forcibly during the
+// shutdown.
+func (ts *TestServer) ForcedCount() int {
+	return ts.Server.ForceClosedCount()
+}
@@ -0,0 +1,48 @@
+package mannerstest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	ready := make(chan bool, 1)
+	handlers := map[string]http.HandlerFunc{
+		"quick": func(w http.ResponseWriter, r *http.Request) {},
+		"wedged": func(w http.ResponseWriter, r *http.Request) {
+			ready <- true
+			<-release
+		},
+	}
+	tests := []struct {
+		handler string
+		drained bool
+		counts  [2]int
+	}{
+		{"quick", true, [2]int{1, 0}},
+		{"wedged", false, [2]int{0, 1}},
+	}
+	for _, test := range tests {
+		ts := NewTestServer(handlers[test.handler])
+		if test.handler == "wedged" {
+			go http.Get(ts.URL)
+			<-ready
+		} else {
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		if drained := ts.Shutdown(50 * time.Millisecond); drained != test.drained {
+			t.Errorf("%s: expected drained %v, got %v", test.handler, test.drained, drained)
+		}
+		if counts := [2]int{ts.DrainedCount(), ts.ForcedCount()}; counts != test.counts {
+			t.Errorf("%s: expected %v connections drained and forced, got %v", test.handler, test.counts, counts)
+		}
+	}
+}
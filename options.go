@@ -0,0 +1,53 @@
+package manners
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// An Option configures a GracefulServer in NewServer. Every option sets one
+// of the server's fields, which may also be set directly.
+type Option func(*GracefulServer)
+
+// Sets ShutdownTimeout.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(s *GracefulServer) {
+		s.ShutdownTimeout = d
+	}
+}
+
+// Sets Logger.
+func WithLogger(l Logger) Option {
+	return func(s *GracefulServer) {
+		s.Logger = l
+	}
+}
+
+// Sets MaxConnections.
+func WithMaxConnections(n int) Option {
+	return func(s *GracefulServer) {
+		s.MaxConnections = n
+	}
+}
+
+// Sets ReadHeaderTimeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *GracefulServer) {
+		s.ReadHeaderTimeout = d
+	}
+}
+
+// Sets InnerServer's BaseContext.
+func WithBaseContext(f func(net.Listener) context.Context) Option {
+	return func(s *GracefulServer) {
+		s.InnerServer.BaseContext = f
+	}
+}
+
+// Sets InnerServer's ConnContext.
+func WithConnContext(f func(context.Context, net.Conn) context.Context) Option {
+	return func(s *GracefulServer) {
+		s.InnerServer.ConnContext = f
+	}
+}
@@ -0,0 +1,113 @@
+package manners
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The longest PROXY protocol v1 header allowed by the specification,
+// including the trailing CRLF.
+const maxProxyHeaderLength = 107
+
+// A proxyConn strips the PROXY protocol v1 header a load balancer sends
+// ahead of the client's data, and reports the client's address from it as
+// RemoteAddr. The header is read on the first call to Read or RemoteAddr,
+// which the http.Server makes from the connection's own goroutine, so a slow
+// client doesn't hold up the accept loop. A connection with a malformed
+// header is closed.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+
+	// If set, called with the client's address once the header has been
+	// read. The connection is closed if it returns false.
+	admit func(*proxyConn, net.Addr) bool
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{Conn: conn, r: bufio.NewReaderSize(conn, maxProxyHeaderLength)}
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	line, err := c.r.ReadSlice('\n')
+	if err == nil {
+		c.remoteAddr, err = parseProxyHeader(string(line))
+	}
+	if err == nil && c.admit != nil {
+		addr := c.remoteAddr
+		if addr == nil {
+			addr = c.Conn.RemoteAddr()
+		}
+		if !c.admit(c, addr) {
+			err = errTooManyConnsFromIP
+		}
+	}
+	if err != nil {
+		c.err = err
+		c.Conn.Close()
+	}
+}
+
+var (
+	errBadProxyHeader     = errors.New("manners: malformed PROXY protocol header")
+	errTooManyConnsFromIP = errors.New("manners: too many connections from the client's address")
+)
+
+// Parses a PROXY protocol v1 header line such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" and returns the source
+// address. For "PROXY UNKNOWN" it returns nil, meaning the connection's own
+// address should be used.
+func parseProxyHeader(line string) (net.Addr, error) {
+	if !strings.HasSuffix(line, "\r\n") {
+		return nil, errBadProxyHeader
+	}
+	fields := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil {
+		return nil, errBadProxyHeader
+	}
+	if isIPv4 := ip.To4() != nil; isIPv4 != (fields[1] == "TCP4") {
+		return nil, errBadProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errBadProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,127 @@
+package manners
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		line string
+		addr string
+		ok   bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", false},
+		{"PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+		{"GET / HTTP/1.1\r\n", "", false},
+	}
+	for _, test := range tests {
+		addr, err := parseProxyHeader(test.line)
+		if (err == nil) != test.ok {
+			t.Errorf("%q: unexpected error %v", test.line, err)
+			continue
+		}
+		if addr != nil && addr.String() != test.addr || addr == nil && test.addr != "" {
+			t.Errorf("%q: expected %q, got %v", test.line, test.addr, addr)
+		}
+	}
+}
+
+type remoteAddrHandler struct{}
+
+func (remoteAddrHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	io.WriteString(resp, req.RemoteAddr)
+}
+
+// Tests that the client address from the PROXY header is reported as the
+// request's RemoteAddr, and that a malformed header closes the connection.
+func TestProxyProtocol(t *testing.T) {
+	server := NewServer()
+	server.ProxyProtocol = true
+	addr, exited := startServer(t, server, remoteAddrHandler{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn.Close()
+	if string(body) != "192.0.2.1:56324" {
+		t.Fatalf("Expected RemoteAddr 192.0.2.1:56324, got %q", body)
+	}
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Expected a connection without a PROXY header to be closed")
+	}
+	conn.Close()
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxConnectionsPerIPProxyProtocol(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.ProxyProtocol = true
+	server.MaxConnectionsPerIP = 1
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	io.WriteString(first, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-ready
+
+	// Another client behind the same proxy is let through.
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	io.WriteString(other, "PROXY TCP4 192.0.2.2 198.51.100.1 56325 443\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "PROXY TCP4 192.0.2.1 198.51.100.1 56326 443\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Expected a connection over the limit to be closed")
+	}
+	conn.Close()
+	waitFor(t, func() bool { return server.ConnectionCount() == 2 })
+
+	close(release)
+	server.Close()
+	<-exited
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.connsPerIP) != 0 || len(server.proxied) != 0 {
+		t.Fatalf("Expected no connections left counted, got %v and %v", server.connsPerIP, server.proxied)
+	}
+}
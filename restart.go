@@ -0,0 +1,136 @@
+package manners
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// The environment variable through which Restart tells the new process how
+// many listening sockets it hands over, starting at file descriptor 3.
+const listenFdsEnv = "MANNERS_LISTEN_FDS"
+
+// Starts a new instance of the running binary, with the same arguments and
+// environment, and hands it every listener the server is serving, then
+// closes the server so that this process drains. Connections arriving from
+// then on are accepted by the new process. Its output goes to this
+// process's standard output and error. Returns an error, without closing
+// the server, if a listener has no file descriptor to hand over, such as
+// one wrapped by crypto/tls, or if the new process can't be started, and
+// otherwise the error from Close.
+//
+// The new process must take over the listeners on startup with
+// ListenAllInherited, which returns them in the order they were added to
+// this server, or with ListenInherited if there is only one. Both return an
+// error when the process wasn't started by Restart, so that it can fall
+// back to ListenAndServe:
+//
+//	l, err := manners.ListenInherited(server)
+//	if err != nil {
+//		return server.ListenAndServe(addr, handler)
+//	}
+//	return server.Serve(l, handler)
+//
+// Restart doesn't wait for the new process. Not supported on Windows.
+func (s *GracefulServer) Restart() error {
+	s.mu.Lock()
+	listeners := append([]net.Listener(nil), s.listeners...)
+	serving := s.serving
+	s.mu.Unlock()
+	if !serving || len(listeners) == 0 {
+		return errors.New("manners: Restart called before Serve")
+	}
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("manners: Restart can't hand over the listener on %s: it has no file descriptor", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at descriptor 3.
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFdsEnv+"="+strconv.Itoa(len(files)))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("manners: starting %s: %w", exe, err)
+	}
+	s.logf("manners: restarted as process %d", cmd.Process.Pid)
+	cmd.Process.Release()
+	return s.Close()
+}
+
+// Creates a GracefulListener from the listener handed over by Restart in the
+// process that started this one. Returns an error if this process wasn't
+// started by Restart, or if it was handed more than one listener, which
+// only ListenAllInherited takes over.
+func ListenInherited(s *GracefulServer) (*GracefulListener, error) {
+	listeners, err := ListenAllInherited(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, fmt.Errorf("manners: %d listeners inherited; use ListenAllInherited", len(listeners))
+	}
+	return listeners[0], nil
+}
+
+// Creates GracefulListeners from all the listeners handed over by Restart in
+// the process that started this one, in the order that process served
+// them. Serve the first with Serve and register the others with
+// AddListener. Returns an error if this process wasn't started by Restart.
+func ListenAllInherited(s *GracefulServer) ([]*GracefulListener, error) {
+	v := os.Getenv(listenFdsEnv)
+	if v == "" {
+		return nil, errors.New("manners: no listener inherited: " + listenFdsEnv + " is not set")
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("manners: invalid %s %q", listenFdsEnv, v)
+	}
+
+	// Don't pass the listeners on to child processes.
+	os.Unsetenv(listenFdsEnv)
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFdsStart+i), "listener")
+		defer files[i].Close()
+	}
+	listeners := make([]*GracefulListener, 0, n)
+	for _, f := range files {
+		l, err := NewListenerFromFile(f, s)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,103 @@
+package manners
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tests that after Restart the new process accepts connections on every
+// listener while this one drains. The new process is this test binary
+// running just this test, which then serves the inherited listeners until
+// it has answered a request on each.
+func TestRestart(t *testing.T) {
+	if os.Getenv(listenFdsEnv) != "" {
+		serveRestarted(t)
+		return
+	}
+
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "parent")
+	})
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+	second, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(NewListener(second, server)); err != nil {
+		t.Fatal(err)
+	}
+	go http.Get("http://" + addr + "/wedged")
+	<-ready
+
+	args, stdout, stderr := os.Args, os.Stdout, os.Stderr
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Args = []string{args[0], "-test.run=^TestRestart$"}
+	os.Stdout, os.Stderr = devNull, devNull
+	err = server.Restart()
+	os.Args, os.Stdout, os.Stderr = args, stdout, stderr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, a := range []string{addr, second.Addr().String()} {
+		resp, err := client.Get("http://" + a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "child" {
+			t.Fatalf("Expected the new process to answer on %s, got %q", a, body)
+		}
+	}
+	select {
+	case <-exited:
+		t.Fatal("The old process stopped before its request finished")
+	default:
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Serves the listeners inherited from TestRestart until it has answered a
+// request on each.
+func serveRestarted(t *testing.T) {
+	server := NewServer()
+	listeners, err := ListenAllInherited(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range listeners[1:] {
+		if err := server.AddListener(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.AfterFunc(10*time.Second, func() { server.Close() })
+	var answered int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "child")
+		if atomic.AddInt32(&answered, 1) == int32(len(listeners)) {
+			go server.Close()
+		}
+	})
+	if err := server.Serve(listeners[0], handler); err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
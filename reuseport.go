@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package manners
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// Creates a GracefulListener on a socket with SO_REUSEPORT and SO_REUSEADDR
+// set, so that another process can bind the same address at the same time.
+// A new process started this way takes over accepting connections while the
+// old one drains, without the listener having to be passed down to it. The
+// kernel spreads new connections over every process still listening.
+func ListenReusePort(s *GracefulServer, network, addr string) (*GracefulListener, error) {
+	lc := net.ListenConfig{Control: setReusePort}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, s), nil
+}
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err == nil {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
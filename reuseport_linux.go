@@ -0,0 +1,6 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le
+
+package manners
+
+// The syscall package predates SO_REUSEPORT on Linux.
+const soReusePort = 0xf
@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package manners
+
+// SO_REUSEPORT has a different value on MIPS.
+const soReusePort = 0x200
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package manners
+
+import (
+	"errors"
+	"runtime"
+)
+
+// SO_REUSEPORT is not available on this platform, so ListenReusePort always
+// returns an error.
+func ListenReusePort(s *GracefulServer, network, addr string) (*GracefulListener, error) {
+	return nil, errors.New("manners: SO_REUSEPORT is not supported on " + runtime.GOOS)
+}
@@ -1,17 +1,138 @@
 package manners
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Creates a new GracefulServer. The server will begin shutting down when
-// a value is passed to the Shutdown channel.
-func NewServer() *GracefulServer {
-	return &GracefulServer{
-		Shutdown: make(chan bool),
+// Returned by Serve and ListenAndServe once the server has been closed and
+// has drained. It is the same value as http.ErrServerClosed, so code that
+// checks for one works with the other.
+var ErrServerClosed = http.ErrServerClosed
+
+// Returned by Serve and AddListener when the listener is already being
+// served, or registered to be, by the same server. Accepting from it twice
+// would count its connections twice.
+var ErrListenerAlreadyServing = errors.New("manners: listener is already being served")
+
+// Receives messages about the server's shutdown. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// How often the number of remaining connections is logged during a drain.
+const drainLogInterval = 5 * time.Second
+
+// How often DrainProgress is called if DrainProgressInterval is not set.
+const defaultDrainProgressInterval = time.Second
+
+// The most batches StaggerForceClose splits the connections into.
+const staggerBatches = 20
+
+// How long ShutdownConnWriter has if ShutdownConnWriteTimeout is not set.
+const defaultShutdownConnWriteTimeout = 100 * time.Millisecond
+
+// Creates a new GracefulServer configured by opts, which are applied in
+// order. The server will begin shutting down when a value is passed to the
+// Shutdown channel. A zero GracefulServer is ready to use as well, with the
+// same settings except that it has no Shutdown channel and leaves the TCP
+// keep-alive period of its connections as the listener set it up.
+func NewServer(opts ...Option) *GracefulServer {
+	s := &GracefulServer{
+		Shutdown:        make(chan bool),
+		KeepAlivePeriod: 3 * time.Minute,
 	}
+	s.init()
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Makes the channels and maps of a server that wasn't created by NewServer.
+// Every entry point that may be reached before Serve calls it first.
+func (s *GracefulServer) init() {
+	s.initOnce.Do(func() {
+		s.closed = make(chan struct{})
+		s.listening = make(chan struct{})
+		s.conns = make(map[net.Conn]*trackedConn)
+		s.hijacked = make(map[*gracefulConn]*trackedConn)
+		s.drained = make(chan struct{})
+		s.forced = make(chan struct{})
+		s.completed = make(chan struct{})
+		s.exited = make(chan struct{})
+		s.events = make(chan ShutdownEvent, eventBuffer)
+		s.connClosed = sync.NewCond(&s.mu)
+	})
+}
+
+// Limits on how long the connections in each state may stay open once the
+// server has stopped accepting connections. A connection still in the state
+// when its limit elapses is closed forcibly, as though ShutdownTimeout had
+// elapsed for it alone. Zero means no limit. New connections are bounded by
+// HandshakeTimeout instead.
+type DrainPolicy struct {
+	// For connections waiting for another request. Close closes idle
+	// HTTP/1 connections right away unless KeepIdleOnShutdown is set, so
+	// this applies to HTTP/2 ones, which are otherwise left for their
+	// clients to close after a GOAWAY. If it is set, this applies to every
+	// idle connection, which is otherwise left open for good.
+	IdleTimeout time.Duration
+
+	// For connections with a request in flight.
+	ActiveTimeout time.Duration
+
+	// For hijacked connections tracked because of TrackHijacked.
+	HijackedTimeout time.Duration
+}
+
+// The order of the connections closed forcibly; see
+// GracefulServer.ForceCloseOrder.
+type ForceCloseOrder int
+
+const (
+	// No particular order.
+	ForceCloseAnyOrder ForceCloseOrder = iota
+
+	// The connections accepted first are closed first, since they are the
+	// likeliest to be stuck.
+	ForceCloseOldestFirst
+
+	// The connections accepted last are closed first, sparing long-lived
+	// sessions for as long as possible.
+	ForceCloseNewestFirst
+)
+
+// A subsystem, such as a database pool or a queue consumer, that shuts down
+// along with a GracefulServer; see RegisterDrainable.
+type Drainable interface {
+	// Finishes the subsystem's outstanding work, giving up once ctx is
+	// done.
+	Drain(ctx context.Context) error
+}
+
+// Adapts a function to a Drainable.
+type drainFunc func(ctx context.Context) error
+
+func (f drainFunc) Drain(ctx context.Context) error { return f(ctx) }
+
+// Limits the rate of an operation; see AcceptLimiter.
+type Limiter interface {
+	// Blocks until the operation may go ahead, or returns an error once
+	// ctx is done.
+	Wait(ctx context.Context) error
 }
 
 // A GracefulServer maintains a WaitGroup that counts how many in-flight
@@ -19,65 +140,3167 @@ func NewServer() *GracefulServer {
 // it stops accepting new requests but does not actually shut down until
 // all in-flight requests terminate.
 type GracefulServer struct {
-	Shutdown        chan bool
-	wg              sync.WaitGroup
-	shutdownHandler func()
-	InnerServer     http.Server
+	Shutdown chan bool
+
+	// The server that handles the connections. Its settings, such as
+	// ReadTimeout, WriteTimeout and IdleTimeout, apply as usual; Handler
+	// and ConnState are overwritten by Serve. A connection the inner server
+	// closes because it timed out leaves the drain like any other closed
+	// connection, so an IdleTimeout also bounds how long an idle keep-alive
+	// connection can hold up a shutdown.
+	//
+	// BaseContext and ConnContext are honoured. The context of each
+	// connection, which its requests' contexts derive from, is cancelled
+	// once the connection closes, or just before it is closed forcibly,
+	// so a handler still running at the ShutdownTimeout sees ctx.Done()
+	// before its connection goes away. A hijacked connection that isn't
+	// tracked has its context cancelled when the hijacking handler
+	// returns, as net/http does.
+	InnerServer http.Server
+
+	// How long to wait for in-flight requests once shutdown has begun.
+	// Connections still open when it elapses are closed forcibly. Zero
+	// means wait forever.
+	ShutdownTimeout time.Duration
+
+	// How long the responses in flight when Close is called may take to be
+	// written. Close sets a write deadline that far ahead on every active
+	// connection, so that a client reading a response very slowly is cut
+	// off instead of holding up the drain until ShutdownTimeout. The
+	// deadline replaces the one InnerServer's WriteTimeout set, so it
+	// should be shorter. Zero means no limit.
+	ActiveDrainTimeout time.Duration
+
+	// Separate limits on how long connections in each state may hold up
+	// the drain, applied in addition to ShutdownTimeout.
+	DrainPolicy DrainPolicy
+
+	// Whether the drain waits for the requests in flight rather than for
+	// the connections: once Close has been called and no request is being
+	// handled, the connections that are new or idle are closed instead of
+	// waited for. HTTP/2 connections are still left to close after their
+	// GOAWAY, which keeps a response that is being flushed from being cut
+	// off. See ActiveRequestCount.
+	WaitForRequestsNotConnections bool
+
+	// Called in its own goroutine once Close has closed the listeners, so
+	// that a gRPC server stops taking new RPCs before the drain closes
+	// any connection forcibly. Typically the GracefulStop method of a
+	// grpc.Server serving its own listener; to have the drain wait for it
+	// too, register it with RegisterDrainable instead or as well. May be
+	// nil.
+	GRPCGracefulStop func()
+
+	// How long Close keeps accepting and serving new connections before it
+	// closes the listeners, even if no connections are open. This gives a
+	// load balancer that has been told the server is going away time to
+	// stop sending it traffic, so that late arrivals aren't refused.
+	// Keep-alives are disabled for the period, and it counts towards the
+	// timeout of BlockingCloseWithTimeout but not towards ShutdownTimeout.
+	MinDrainDuration time.Duration
+
+	// Whether to leave idle keep-alive connections open when shutdown
+	// begins. By default Close closes them, and connections that become
+	// idle while the server drains: such a connection has no request in
+	// flight, so closing it loses nothing, whereas waiting for the client
+	// to hang up may take forever. When set, idle connections are left
+	// open until their clients close them or InnerServer's IdleTimeout
+	// elapses, while the HTTP/1 responses written during the drain still
+	// carry Connection: close.
+	KeepIdleOnShutdown bool
+
+	// How long a new connection may take to complete its TLS handshake,
+	// and to send the headers of its first HTTP/1 request, before it is
+	// closed. This keeps clients that open a connection and then stall
+	// from holding up a drain for long. Applies to plain HTTP connections
+	// as well, bounding the wait for the first request. If InnerServer has
+	// a ReadHeaderTimeout, ReadTimeout or WriteTimeout, net/http bounds the
+	// handshake by the shortest of them instead. Zero means no limit.
+	HandshakeTimeout time.Duration
+
+	// If set, replaces InnerServer's ReadHeaderTimeout when Serve is
+	// called: how long a client may take to send the headers of each
+	// request, so that one sending them a byte at a time can't hold up a
+	// drain. The inner server closes a connection that times out, which
+	// then leaves the drain like any other closed connection; headers
+	// larger than InnerServer's MaxHeaderBytes are refused right away with
+	// a 431 instead. Unlike HandshakeTimeout, it applies to every request
+	// on a keep-alive connection, not just the first.
+	ReadHeaderTimeout time.Duration
+
+	// Called during the TLS handshake of every connection served by
+	// ServeTLS and the ListenAndServeTLS methods, before the TLSConfig's
+	// own GetConfigForClient, to pick the connections to serve, for
+	// instance by server name. The handshake of a connection for which it
+	// returns false fails, and the connection is closed without being
+	// counted by the drain. May be nil, which serves every connection.
+	InspectClientHello func(*tls.ClientHelloInfo) (handleLocally bool)
+
+	// The most connections to serve at once. While that many are open,
+	// the listener doesn't accept any more, leaving them in the kernel's
+	// backlog. Zero means no limit. Use SetMaxConnections to change it once
+	// Serve has started.
+	MaxConnections int
+
+	// The most connections to serve at once from a single client IP
+	// address. The listener closes a connection from an address that is
+	// already at the limit right away, without it being counted by the
+	// drain. With ProxyProtocol the address is the client's from the
+	// header, and the limit is enforced once the header has been read. A
+	// connection stops counting when it closes, or when it is hijacked
+	// and TrackHijacked isn't set. Zero means no limit.
+	MaxConnectionsPerIP int
+
+	// Limits the rate at which the listener accepts new connections: Accept
+	// waits on it before accepting each one, leaving the others in the
+	// kernel's backlog. A *rate.Limiter from golang.org/x/time/rate will
+	// do, as in rate.NewLimiter(100, 10) for 100 connections a second in
+	// bursts of up to 10. Closing the listener ends the wait. Nil means no
+	// limit.
+	AcceptLimiter Limiter
+
+	// Creates the listener for ListenAndServe, ListenAndServeTLS and
+	// ListenAndServeTLSConfig, in place of net.Listen("tcp", addr), so that
+	// a listener with its own accept behaviour, such as an IP allowlist,
+	// can be used with them. The server wraps it in a GracefulListener.
+	// May be nil.
+	ListenerFactory func(addr string) (net.Listener, error)
+
+	// Used by ListenAndServe, ListenAndServeTLS and
+	// ListenAndServeTLSConfig to create their listener when there is no
+	// ListenerFactory, so that its Control function can set socket options
+	// such as buffer sizes or IP_FREEBIND before the socket is bound. Nil
+	// means net.Listen.
+	ListenConfig *net.ListenConfig
+
+	// Whether ListenAndServeAll fails if any of the local addresses can't
+	// be bound, rather than serving on the others and logging the failures.
+	RequireAllAddresses bool
+
+	// The TCP options below are set on accepted TCP connections and
+	// ignored for other kinds of connections, such as Unix sockets.
+
+	// The TCP keep-alive period, so that connections to clients that have
+	// gone away are noticed and stop holding up a drain. Zero leaves the
+	// connections as the listener set them up; a negative value turns
+	// keep-alives off. NewServer sets it to three minutes, like net/http.
+	KeepAlivePeriod time.Duration
+
+	// Whether to disable Nagle's algorithm, sending small writes right
+	// away instead of coalescing them. Nil leaves the operating system's
+	// default, which in Go is true.
+	TCPNoDelay *bool
+
+	// Whether to keep waiting for connections that a handler hijacked,
+	// such as WebSockets, during a drain. Normally the server forgets about
+	// a connection once it is hijacked. When set, the connection counts
+	// towards the drain until the handler closes it, it is listed by
+	// HijackedConnections, and it is closed forcibly when ShutdownTimeout
+	// elapses. Setting it wraps every accepted connection, which costs a
+	// little performance.
+	//
+	// The inner server never takes a hijacked connection back, so it
+	// belongs to the handler for good. Either way it stops counting exactly
+	// once: when it is hijacked, or, when this is set, when it is first
+	// closed, passed to MarkClosed or closed forcibly. A handler that hands
+	// it to another listener of this server has it counted again as a new
+	// connection.
+	TrackHijacked bool
+
+	// Whether to count the bytes read from and written to each connection,
+	// and note when it was last used, for ConnectionStats. The connections
+	// the inner server sees are then wrapped, rather than being the ones
+	// returned by the underlying listener.
+	CountBytes bool
+
+	// Whether to leave connections untracked. When set, the listener hands
+	// the inner server the connections as it accepted them, without the
+	// wrapping of CountBytes or TrackHijacked, and the server neither
+	// counts them nor notes their state, for the least overhead per
+	// connection. Close then doesn't drain: it closes
+	// the listeners and the idle connections, and Serve returns right
+	// away, leaving the requests in flight to finish on their own unless
+	// the process exits first. Features built on the tracking, such as
+	// ShutdownTimeout, ConnectionCount, MaxConnections and DrainPolicy,
+	// have no effect; CountOnly keeps the drain for little more. Must be
+	// set before Serve.
+	DisableTracking bool
+
+	// Whether to count connections without keeping a record of each, as
+	// manners did before it tracked them one by one. Close still waits for
+	// the connections to close, and ConnectionCount, WaitForZeroConnections
+	// and MaxConnections still work, at a fraction of the cost per
+	// connection. Features that need to find or close a given connection,
+	// such as ConnectionStats, DrainMatching, DrainPolicy, RemoveListener,
+	// TrackHijacked, CountBytes and MaxConnectionsPerIP, have no effect, and
+	// once ShutdownTimeout elapses Serve returns without closing the
+	// connections left. Ignored if DisableTracking is set. Must be set
+	// before Serve.
+	CountOnly bool
+
+	// Called with every temporary error returned by the Accept method of
+	// the underlying listener, such as running out of file descriptors.
+	// Accept is retried after such errors with a delay growing up to a
+	// second; other errors end Serve and are returned. May be nil.
+	AcceptError func(error)
+
+	// Reports whether an error that ended Serve on one of the listeners
+	// means the listener was closed on purpose, for listeners that report
+	// being closed with an error of their own. Such an error ends Serve
+	// with ErrServerClosed once the server drains, instead of being
+	// returned as a failure. Errors from a GracefulListener that was
+	// closed, and errors matching net.ErrClosed from any listener once the
+	// server has closed its listeners, are recognized either way. May be
+	// nil.
+	IsClosedErr func(error) bool
+
+	// Whether to recover from a panic in the Accept method of the
+	// underlying listener, as can happen with a faulty wrapper around it.
+	// The panic is logged and Accept is retried, instead of the panic
+	// tearing down the process along with every open connection. Closing
+	// the listener still stops the server as usual.
+	RecoverAccept bool
+
+	// Called by the listener with every connection it accepts, after the
+	// server's own wrapping, such as for ProxyProtocol or TrackHijacked.
+	// The connection it returns is handed to the inner server instead, so
+	// it can set deadlines on the connection or wrap it. For TrackHijacked
+	// to keep working, a wrapper must pass Close through to the connection
+	// it wraps and return it from a NetConn method, as tls.Conn does.
+	// May be nil.
+	ConnWrapper func(net.Conn) net.Conn
+
+	// Whether connections start with a PROXY protocol v1 header, as sent
+	// by HAProxy or an AWS Network Load Balancer. The header is stripped
+	// and the client address it carries is reported as the connection's
+	// RemoteAddr, and thus as the request's RemoteAddr. Connections with a
+	// malformed header are closed.
+	ProxyProtocol bool
+
+	// Whether to turn away requests that arrive on open connections once
+	// Drain or Close has been called, rather than serving them. Such a
+	// request gets RejectHandler's response and its connection is closed,
+	// so a load balancer can retry it on another server. Requests that are
+	// already being handled when shutdown begins complete normally.
+	RejectDuringShutdown bool
+
+	// Responds to requests rejected by RejectDuringShutdown. Nil responds
+	// with 503 Service Unavailable.
+	RejectHandler http.Handler
+
+	// Serves the requests that arrive once Drain has been called, in place
+	// of the handler passed to Serve, such as a static "try again" page.
+	// When it is set, Drain keeps the listeners open, so that new
+	// connections get the page as well while a load balancer catches up,
+	// until Close closes them. RejectDuringShutdown takes precedence over
+	// it. May be nil.
+	MaintenanceHandler http.Handler
+
+	// Where to log the progress of a shutdown: when it begins, how many
+	// connections remain while the server drains, and errors closing the
+	// listener or accepting connections. Nil discards the messages.
+	Logger Logger
+
+	// Called once, synchronously, when Close is first called, before the
+	// listeners are closed. A readiness check can start failing here so
+	// that the load balancer stops sending traffic. May be nil.
+	OnShutdownInitiated func()
+
+	// The path of a file that exists while the server is ready, for
+	// readiness probes that check for a file rather than calling an
+	// endpoint. Serve creates it once it is listening, and Close or Drain
+	// removes it before the listeners are closed, as ReadinessHandler
+	// starts failing. Empty means no file.
+	ReadinessFile string
+
+	// Called once by Serve when the drain is over, either because every
+	// connection has finished or because the rest were closed forcibly,
+	// just before Serve returns. May be nil.
+	OnShutdownComplete func()
+
+	// Called every DrainProgressInterval during a drain with the number of
+	// connections that remain, as reported by ConnectionCount, until they
+	// have all finished or the ShutdownTimeout elapses. May be nil.
+	DrainProgress func(remaining int)
+
+	// How often DrainProgress is called. Defaults to a second.
+	DrainProgressInterval time.Duration
+
+	// Called with every connection that is closed forcibly because the
+	// ShutdownTimeout or a DrainPolicy limit elapsed, just before it is
+	// closed. Unlike a connection that drained, such a connection may have
+	// lost a response. May be nil.
+	OnForceClose func(net.Conn)
+
+	// Whether the TCP connections closed forcibly are reset rather than
+	// closed normally: their linger time is set to zero, so that the
+	// client gets an RST instead of a FIN and fails right away, rather than
+	// taking a truncated response for a whole one or waiting on it.
+	ForceCloseWithReset bool
+
+	// The order in which connections closed forcibly together are closed,
+	// and passed to OnForceClose. Defaults to no particular order.
+	ForceCloseOrder ForceCloseOrder
+
+	// Spreads the connections closed forcibly once the ShutdownTimeout, or
+	// the timeout of BlockingCloseWithTimeout and the like, elapses over
+	// this window, so that their clients don't all reconnect to the next
+	// server at the same instant. The connections are closed in up to 20
+	// batches in ForceCloseOrder: the first right away, and each of the
+	// others at a random point of its share of the window. A connection
+	// that finishes before its batch is closed drains as usual, and Serve
+	// returns as soon as no connection is left. Zero closes them all at
+	// once. Connections closed because of a DrainPolicy limit or a drain
+	// deadline, or by CloseWithin(0), are closed right away.
+	StaggerForceClose time.Duration
+
+	// Called with every connection about to be closed forcibly, before
+	// OnForceClose, to write a farewell the client understands, such as
+	// an SSE "event: shutdown" frame or a WebSocket close frame. The
+	// connection is the one the handler sees, so for TLS it writes
+	// through the TLS session. A handler may still be writing to it, so
+	// the farewell should be one the protocol allows between messages.
+	// The calls for connections closed together are made concurrently,
+	// with the connections' write deadlines set ShutdownConnWriteTimeout
+	// ahead; the connections are closed once every call has returned or
+	// the timeout has elapsed, whether or not it returned an error. May be
+	// nil.
+	ShutdownConnWriter func(net.Conn) error
+
+	// How long ShutdownConnWriter has. Defaults to 100ms.
+	ShutdownConnWriteTimeout time.Duration
+
+	// Called whenever a connection changes state, like
+	// http.Server.ConnState, which the GracefulServer uses for its own
+	// bookkeeping. The server has already accounted for the new state by
+	// the time it is called. May be nil.
+	StateChanged func(net.Conn, http.ConnState)
+
+	wg sync.WaitGroup
+
+	mu         sync.Mutex
+	listeners  []net.Listener
+	serving    bool
+	draining   bool
+	closing    bool
+	closed     chan struct{}
+	listening  chan struct{}
+	listener   net.Listener
+	addr       net.Addr
+	signals    func()
+	onShutdown []func()
+	conns      map[net.Conn]*trackedConn
+	hijacked   map[*gracefulConn]*trackedConn
+	connClosed *sync.Cond
+	drained    chan struct{}
+	forced     chan struct{}
+	forceOnce  sync.Once
+
+	// The subsystems registered with RegisterDrainable, the errors their
+	// Drain returned, and a channel closed once they have all returned.
+	drainables    []Drainable
+	drainablesErr error
+	completed     chan struct{}
+
+	// Closed once Serve has returned, with what it returned and the
+	// outcome Wait reports.
+	exited   chan struct{}
+	serveErr error
+	exitErr  error
+
+	initOnce      sync.Once
+	initiatedOnce sync.Once
+	closeOnce     sync.Once
+
+	// When the listeners were closed, and how long it took from then until
+	// the server drained.
+	drainStart    time.Time
+	drainDuration time.Duration
+
+	// The number of connections forceClose has closed.
+	timedOut int
+
+	// The most connections open at once; see PeakConnections.
+	peakConns int
+
+	// The number of connections from each client IP address under
+	// MaxConnectionsPerIP, counting those a listener has admitted but that
+	// haven't been reported as StateNew yet, the client IP address of each
+	// of the latter, and with ProxyProtocol, the tracked connection of each
+	// proxyConn whose header hasn't been read yet.
+	connsPerIP map[string]int
+	reservedIP map[net.Conn]string
+	proxied    map[*proxyConn]*trackedConn
+
+	// The slots under MaxConnections that listeners have reserved for
+	// connections that haven't been reported as StateNew yet, and the
+	// connections returned by a listener that hold one of them, whose
+	// number is also kept in slotsHeld, which is updated atomically.
+	reservedConns int
+	heldSlots     map[net.Conn]bool
+	slotsHeld     int32
+
+	// The channel returned by Events, whether Events was called, and
+	// whether the channel was closed after EventCompleted.
+	events       chan ShutdownEvent
+	eventsRead   bool
+	eventsClosed bool
+
+	// The *tls.Certificate served by ListenAndServeTLS.
+	certificate atomic.Value
+
+	// The configuration whose keys encrypt the session tickets of the TLS
+	// connections; see ServeTLS.
+	tickets *tls.Config
+
+	// InnerServer's TLSConfig as the caller set it, and the configuration
+	// ServeTLS built and installed in its place.
+	tlsConfig        *tls.Config
+	derivedTLSConfig *tls.Config
+
+	// The handlerValue passed to SetHandler.
+	handler atomic.Value
+
+	// Set to 1 by Drain when the MaintenanceHandler takes over.
+	maintenance int32
+
+	// The number of requests being handled.
+	activeRequests int64
+
+	// The number of requests being handled by TrackRequests handlers.
+	trackedRequests int
+
+	// How Serve serves each listener, the number of listeners it is still
+	// serving, and where their results go, so that AddListener can serve
+	// more once Serve has started. serveFuncs holds how each listener is
+	// served, for a listener passed to a later Serve or ServeTLS call.
+	serveListener func(net.Listener) error
+	serveFuncs    map[net.Listener]func(net.Listener) error
+	acceptLoops   int
+	acceptErrs    chan error
+
+	// Whether Serve has stopped accepting for good, so that Undrain is too
+	// late.
+	stopped bool
+
+	// The file mode ListenAndServeUnix gave each socket, for Undrain to
+	// give it again.
+	unixModes map[string]os.FileMode
+
+	// The listeners closed by RemoveListener, and the listener each
+	// connection accepted but not yet reported as StateNew came from.
+	removed map[net.Listener]bool
+	pending map[net.Conn]net.Listener
+
+	// The functions cancelling the contexts of the connections that have
+	// been passed to ConnContext but not yet reported as StateNew.
+	cancels map[net.Conn]context.CancelFunc
+
+	// The inner server's ConnContext as it was when Serve was first called.
+	connContext func(context.Context, net.Conn) context.Context
+
+	// The inner server's TLSNextProto as it was when Serve was first
+	// called, before the inner server added its HTTP/2 support to it.
+	tlsNextProto map[string]func(*http.Server, *tls.Conn, http.Handler)
+
+	// Totals of connections accepted, of connections that finished after
+	// Close was called, and of those closed forcibly. Read atomically by
+	// the metrics collector.
+	acceptedCount uint64
+	drainedCount  uint64
+	forcedCount   uint64
+
+	// The connections open under CountOnly. Updated atomically.
+	countedConns int64
+
+	// forcedCount split by whether the connections were active or idle.
+	forcedActiveCount uint64
+	forcedIdleCount   uint64
+}
+
+// Creates the listener for ListenAndServe and the like.
+func (s *GracefulServer) listen(addr string) (net.Listener, error) {
+	if s.ListenerFactory != nil {
+		return s.ListenerFactory(addr)
+	}
+	if s.ListenConfig != nil {
+		return s.ListenConfig.Listen(context.Background(), "tcp", addr)
+	}
+	return net.Listen("tcp", addr)
 }
 
 // A helper function that emulates the functionality of http.ListenAndServe.
 func (s *GracefulServer) ListenAndServe(addr string, handler http.Handler) error {
-	oldListener, err := net.Listen("tcp", addr)
+	oldListener, err := s.listen(addr)
 	if err != nil {
-		return err
+		return s.listenFailed(err)
+	}
+
+	return s.ServeWithOptions(oldListener, handler)
+}
+
+// Like ListenAndServe, but serves on a listener that is already bound, such
+// as one on an ephemeral port in a test. Unless it is a GracefulListener
+// already, the listener is wrapped in one, so that the server's TCP options
+// such as KeepAlivePeriod apply to the connections it accepts.
+func (s *GracefulServer) ServeWithOptions(l net.Listener, handler http.Handler) error {
+	listener, ok := l.(*GracefulListener)
+	if !ok {
+		listener = NewListener(l, s)
+	}
+	s.logf("manners: serving on %v", listener.Addr())
+	return s.Serve(listener, handler)
+}
+
+// Serves l with a GracefulServer set up like srv, for a one-off serve that
+// doesn't need a GracefulServer kept around, such as one in a test. srv
+// isn't used to serve: its settings, Handler and ConnState are copied, and
+// the connections are counted as by GracefulServer.Serve. Calling
+// srv.Shutdown closes the GracefulServer, which drains; Serve returns
+// ErrServerClosed once it has, while srv.Shutdown returns right away.
+func Serve(l net.Listener, srv *http.Server) error {
+	s := NewServer()
+	s.InnerServer = serverConfig(srv)
+	s.StateChanged = srv.ConnState
+	srv.RegisterOnShutdown(func() { s.Close() })
+	return s.ServeWithOptions(l, srv.Handler)
+}
+
+// Like ListenAndServe, but listens on port on every address of the host's
+// network interfaces, IPv4 and IPv6 alike, and serves them all under one
+// drain, as with AddListener. Link-local IPv6 addresses are skipped. With
+// port "0", every address gets a port of its own. Addresses that can't be
+// bound are logged and left out, unless RequireAllAddresses is set, in which
+// case nothing is served. Returns an error if no address could be bound.
+func (s *GracefulServer) ListenAndServeAll(port string, handler http.Handler) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return s.listenFailed(err)
+	}
+	var listeners []net.Listener
+	var errs []error
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		l, err := s.listen(net.JoinHostPort(ipnet.IP.String(), port))
+		if err != nil {
+			s.logf("manners: error listening on %v: %v", ipnet.IP, err)
+			errs = append(errs, err)
+			continue
+		}
+		listeners = append(listeners, NewListener(l, s))
+	}
+	if len(listeners) == 0 || s.RequireAllAddresses && len(errs) > 0 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		if len(errs) == 0 {
+			return s.listenFailed(errors.New("manners: no local address to listen on"))
+		}
+		return s.listenFailed(errors.Join(errs...))
+	}
+	for _, l := range listeners[1:] {
+		if err := s.AddListener(l); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return s.listenFailed(err)
+		}
+	}
+	return s.Serve(listeners[0], handler)
+}
+
+// A helper function that emulates the functionality of
+// http.ListenAndServeTLS. HTTP/2 is negotiated with clients that support it.
+//
+// The server tracks TCP connections, not HTTP/2 streams: a connection is
+// active while any of its streams is, and idle once they have all finished.
+// So on shutdown an HTTP/2 connection is kept open until its last stream
+// ends, and closing it forcibly cuts off every stream it carries.
+func (s *GracefulServer) ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
+	oldListener, err := s.listen(addr)
+	if err != nil {
+		return s.listenFailed(err)
 	}
 
 	listener := NewListener(oldListener, s)
-	err = s.Serve(listener, handler)
-	return err
+	return s.serveTLS(listener, handler, certFile, keyFile)
+}
+
+// Like ListenAndServe, but listens on the Unix domain socket at path and
+// sets its permissions to mode. A stale socket left at path by a process that
+// is gone is removed first; a socket that is still being served is not. The
+// socket is removed again when the server is closed.
+func (s *GracefulServer) ListenAndServeUnix(path string, mode os.FileMode, handler http.Handler) error {
+	if err := removeStaleSocket(path); err != nil {
+		return s.listenFailed(err)
+	}
+	oldListener, err := net.Listen("unix", path)
+	if err != nil {
+		return s.listenFailed(err)
+	}
+	// Only a listener that created the socket unlinks it on Close.
+	oldListener.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, mode); err != nil {
+		oldListener.Close()
+		return s.listenFailed(err)
+	}
+	s.mu.Lock()
+	if s.unixModes == nil {
+		s.unixModes = make(map[string]os.FileMode)
+	}
+	s.unixModes[path] = mode
+	s.mu.Unlock()
+
+	listener := NewListener(oldListener, s)
+	return s.Serve(listener, handler)
 }
 
 // Similar to http.Serve. The listener passed must wrap a GracefulListener.
+// Returns ErrServerClosed after a graceful shutdown, and the listener's error
+// if it fails for any other reason.
+//
+// Called again while the server is serving, it serves the new listener
+// alongside the others, as AddListener does, and returns once the first call
+// returns, with the same error. The handler passed first keeps serving every
+// listener; use SetHandler to replace it. This way ServeTLS can be called
+// on one listener and Serve on another. A call made once the server has
+// stopped accepting closes its listener.
 func (s *GracefulServer) Serve(listener net.Listener, handler http.Handler) error {
-	s.shutdownHandler = func() { listener.Close() }
+	return s.serve(listener, handler, s.InnerServer.Serve)
+}
+
+// Removes the socket at path if nothing is listening on it any more.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("manners: %s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("manners: %s is already being served", path)
+	}
+	return os.Remove(path)
+}
+
+func (s *GracefulServer) serve(listener net.Listener, handler http.Handler, serve func(net.Listener) error) error {
+	s.init()
+	s.mu.Lock()
+	if s.hasListener(listener) {
+		s.mu.Unlock()
+		return ErrListenerAlreadyServing
+	}
+	if s.serving {
+		return s.serveAlongside(listener, serve)
+	}
+	s.SetHandler(handler)
+	s.InnerServer.Handler = s.wrapHandler(http.HandlerFunc(s.serveHTTP))
+	switch {
+	case s.DisableTracking:
+		s.InnerServer.ConnState = s.StateChanged
+	case s.CountOnly:
+		s.InnerServer.ConnState = s.countConnState
+	default:
+		s.InnerServer.ConnState = s.trackConnState
+	}
+	if s.ReadHeaderTimeout > 0 {
+		s.InnerServer.ReadHeaderTimeout = s.ReadHeaderTimeout
+	}
+	s.serving = true
+	s.listener = listener
+	s.addr = listener.Addr()
+	s.connContext = s.InnerServer.ConnContext
+	s.tlsNextProto = s.InnerServer.TLSNextProto
+	s.serveListener = serve
+	s.acceptErrs = make(chan error)
+	// Close and Drain remove the file once they have set these.
+	if !s.closing && !s.draining {
+		s.createReadinessFile()
+	}
+	close(s.listening)
+	if s.tracksConns() {
+		s.InnerServer.ConnContext = s.withConn
+	}
+	// The listeners registered by AddListener before Serve as well.
+	s.listeners = append(s.listeners, listener)
+	for _, l := range s.listeners {
+		s.startAccepting(l, serve)
+	}
+	errs := s.acceptErrs
+	draining := s.closesListeners()
+	s.mu.Unlock()
+	if draining {
+		s.closeListeners()
+	}
 	s.listenForShutdown()
-	s.InnerServer.Handler = handler
-	s.InnerServer.ConnState = func(conn net.Conn, newState http.ConnState) {
-		switch newState {
-		case http.StateNew:
-			s.StartRoutine()
-		case http.StateClosed, http.StateHijacked:
-			s.FinishRoutine()
+
+	var failure error
+	for {
+		err := <-errs
+		s.mu.Lock()
+		s.acceptLoops--
+		left := s.acceptLoops
+		s.mu.Unlock()
+		if !s.isClosedErr(err) && failure == nil {
+			// Stop serving on the other listeners as well.
+			s.logf("manners: error accepting connections: %v", err)
+			failure = err
+			s.Drain()
 		}
+		if left == 0 && !s.awaitUndrain(failure != nil) {
+			break
+		}
+	}
+	if failure != nil {
+		return s.exit(failure)
 	}
-	err := s.InnerServer.Serve(listener)
 
-	// This block is reached when the server has received a shut down command.
-	if err == nil {
-		s.wg.Wait()
-		return nil
-	} else if _, ok := err.(listenerAlreadyClosed); ok {
-		s.wg.Wait()
-		return nil
+	// This is reached when the server has received a shut down command.
+	s.waitForDrain()
+	return s.exit(ErrServerClosed)
+}
+
+// Serves listener alongside those of the Serve call that is serving already,
+// and returns what that call returns once it has. Must be called with s.mu
+// held, which it releases.
+func (s *GracefulServer) serveAlongside(listener net.Listener, serve func(net.Listener) error) error {
+	accepting := !s.closesListeners() && s.acceptLoops > 0
+	if accepting {
+		s.listeners = append(s.listeners, listener)
+		s.startAccepting(listener, serve)
+	}
+	exited := s.exited
+	s.mu.Unlock()
+	if !accepting {
+		listener.Close()
+	}
+	<-exited
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serveErr
+}
+
+// Records err, which kept one of the ListenAndServe methods from serving,
+// as the outcome for Wait, unless Serve has been called already, and returns
+// it.
+func (s *GracefulServer) listenFailed(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.serving {
+		s.exitLocked(err)
 	}
 	return err
 }
 
-// Increments the server's WaitGroup. Use this if a web request starts more
-// goroutines and these goroutines are not guaranteed to finish before the
-// request.
-func (s *GracefulServer) StartRoutine() {
-	s.wg.Add(1)
+// Records the outcome of Serve for Wait, the first time Serve returns, and
+// returns err.
+func (s *GracefulServer) exit(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exitLocked(err)
 }
 
-// Decrement the server's WaitGroup. Used this to complement StartRoutine().
-func (s *GracefulServer) FinishRoutine() {
-	s.wg.Done()
+// Like exit. Must be called with s.mu held.
+func (s *GracefulServer) exitLocked(err error) error {
+	select {
+	case <-s.exited:
+		return err
+	default:
+	}
+	s.serveErr = err
+	switch {
+	case err != ErrServerClosed:
+		s.exitErr = err
+	case s.timedOut > 0:
+		s.exitErr = fmt.Errorf("%w after closing %d connections forcibly: %w", ErrServerClosed, s.timedOut, context.DeadlineExceeded)
+	}
+	close(s.exited)
+	return err
 }
 
-func (s *GracefulServer) listenForShutdown() {
-	go func() {
-		<-s.Shutdown
-		s.shutdownHandler()
+// Replaces the handler passed to Serve. Requests that have already started
+// are finished by the old handler; new ones are passed to h. A nil h means
+// http.DefaultServeMux. Serve sets the handler again when it starts.
+func (s *GracefulServer) SetHandler(h http.Handler) {
+	s.handler.Store(handlerValue{h})
+}
+
+// Passes a request to the current handler.
+func (s *GracefulServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&s.activeRequests, 1)
+	defer func() {
+		if atomic.AddInt64(&s.activeRequests, -1) == 0 {
+			s.closeUnusedConns()
+		}
 	}()
+	defer s.cancelHijacked(r)
+	if s.recordRequest(r) {
+		// The connection is being evicted by DrainMatching. This closes
+		// an HTTP/1 connection after the response, and makes HTTP/2 send
+		// a GOAWAY.
+		w.Header().Set("Connection", "close")
+	}
+	if r.ProtoMajor == 1 && s.KeepIdleOnShutdown {
+		cw := &closingResponseWriter{ResponseWriter: w, server: s}
+		// For a handler that returns without writing anything.
+		defer cw.start()
+		w = cw
+	}
+	if atomic.LoadInt32(&s.maintenance) != 0 {
+		s.MaintenanceHandler.ServeHTTP(w, r)
+		return
+	}
+	h, _ := s.handler.Load().(handlerValue)
+	if h.Handler == nil {
+		http.DefaultServeMux.ServeHTTP(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// A closingResponseWriter adds Connection: close to an HTTP/1 response that
+// starts once Close has been called, so that its client doesn't reuse the
+// connection, without the inner server closing the idle connections as
+// disabling keep-alives would; see KeepIdleOnShutdown.
+type closingResponseWriter struct {
+	http.ResponseWriter
+	server      *GracefulServer
+	wroteHeader bool
+}
+
+// Sets the header, unless the response has started already.
+func (w *closingResponseWriter) start() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.server.mu.Lock()
+	closing := w.server.closing
+	w.server.mu.Unlock()
+	if closing {
+		w.Header().Set("Connection", "close")
+	}
+}
+
+func (w *closingResponseWriter) WriteHeader(code int) {
+	if code >= 200 || code == http.StatusSwitchingProtocols {
+		// Informational responses leave the header to the final one.
+		w.start()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *closingResponseWriter) Write(b []byte) (int, error) {
+	w.start()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *closingResponseWriter) WriteString(str string) (int, error) {
+	w.start()
+	return io.WriteString(w.ResponseWriter, str)
+}
+
+func (w *closingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.start()
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *closingResponseWriter) Flush() {
+	w.start()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *closingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+// Returns the inner server's ResponseWriter, for http.ResponseController.
+func (w *closingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Cancels the context of a connection hijacked by r's handler once the
+// handler has returned, as the inner server does for its own context.
+func (s *GracefulServer) cancelHijacked(r *http.Request) {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	s.mu.Lock()
+	cancel, ok := s.cancels[conn]
+	delete(s.cancels, conn)
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// The context keys under which withConn stores a request's connection and
+// the GracefulServer serving it.
+type (
+	connContextKey   struct{}
+	serverContextKey struct{}
+)
+
+// Installed as the inner server's ConnContext, calling any ConnContext set
+// before Serve.
+func (s *GracefulServer) withConn(ctx context.Context, conn net.Conn) context.Context {
+	if s.connContext != nil {
+		ctx = s.connContext(ctx, conn)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	if s.cancels == nil {
+		s.cancels = make(map[net.Conn]context.CancelFunc)
+	}
+	s.cancels[conn] = cancel
+	s.mu.Unlock()
+	ctx = context.WithValue(ctx, serverContextKey{}, s)
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// Records the host of the first request on a connection for ConnInfo.
+// Reports whether the connection is being evicted by DrainMatching.
+func (s *GracefulServer) recordRequest(r *http.Request) bool {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tc, ok := s.conns[conn]
+	if !ok {
+		return false
+	}
+	if tc.host == "" {
+		tc.host = r.Host
+		if r.TLS != nil {
+			tc.serverName = r.TLS.ServerName
+		}
+	}
+	return tc.evict
+}
+
+// Holds the current handler, so that atomic.Value always stores the same
+// type whatever the handler's type is.
+type handlerValue struct {
+	http.Handler
+}
+
+// Wraps the user's handler to implement RejectDuringShutdown.
+func (s *GracefulServer) wrapHandler(handler http.Handler) http.Handler {
+	if !s.RejectDuringShutdown {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.IsDraining() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// HTTP/2 has no Connection header; the GOAWAY sent on Close does
+		// the same job there.
+		if r.ProtoMajor == 1 {
+			w.Header().Set("Connection", "close")
+		}
+		if s.RejectHandler != nil {
+			s.RejectHandler.ServeHTTP(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// Reports whether err was returned by Serve on a listener that was closed
+// on purpose.
+func (s *GracefulServer) isClosedErr(err error) bool {
+	if err == nil || err == http.ErrServerClosed {
+		return true
+	}
+	if _, ok := err.(listenerAlreadyClosed); ok {
+		return true
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// A listener other than a GracefulListener, closed by Close or
+		// Drain rather than behind the server's back.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.closesListeners() {
+			return true
+		}
+	}
+	return s.IsClosedErr != nil && s.IsClosedErr(err)
+}
+
+// Returns a channel that is closed once Serve has started, at which point
+// Addr is set and the listeners accept connections.
+func (s *GracefulServer) Listening() <-chan struct{} {
+	s.init()
+	return s.listening
+}
+
+// Returns the address of the listener passed to Serve, which tells a server
+// started with ListenAndServe(":0", ...) which port it is bound to. Returns
+// nil until Serve has started; wait on Listening first.
+func (s *GracefulServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Returns the GracefulListener passed to Serve, including the one that
+// ListenAndServe and the like create, for instance to call File on it for a
+// handoff to another process, or to close just that listener. Returns nil
+// until Serve has started, and if the listener passed to it is not a
+// *GracefulListener itself. Once the server has been closed, the listener
+// returned is closed as well.
+func (s *GracefulServer) Listener() *GracefulListener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, _ := s.listener.(*GracefulListener)
+	return l
+}
+
+// Registers another listener to serve alongside the one passed to Serve, so
+// that a server can listen on several addresses at once. All the listeners
+// share the handler and the shutdown: closing the server closes every one of
+// them, and Serve returns once the connections from all of them have
+// drained. Like the listener passed to Serve, l must wrap a
+// GracefulListener. Called before Serve, it has Serve serve l as well;
+// called once Serve has started, it starts serving l right away. Returns an
+// error if the server has stopped accepting connections, and
+// ErrListenerAlreadyServing if l has been registered already.
+func (s *GracefulServer) AddListener(l net.Listener) error {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closesListeners() || (s.serving && s.acceptLoops == 0) {
+		return errors.New("manners: AddListener called after the server stopped accepting connections")
+	}
+	if s.hasListener(l) {
+		return ErrListenerAlreadyServing
+	}
+	s.listeners = append(s.listeners, l)
+	if s.serving {
+		s.startAccepting(l, s.serveListener)
+	}
+	return nil
+}
+
+// Reports whether l has been passed to Serve or AddListener and not removed
+// since. Must be called with s.mu held.
+func (s *GracefulServer) hasListener(l net.Listener) bool {
+	for _, served := range s.listeners {
+		if served == l {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes one of the listeners being served, leaving the others serving,
+// and waits for the connections accepted from it to be done. Like
+// DrainMatching, it closes those that are idle right away and the others
+// once their request has finished. Returns an error if l isn't being served
+// or is the last listener left, which only Close or Drain can close.
+func (s *GracefulServer) RemoveListener(l net.Listener) error {
+	s.mu.Lock()
+	i := -1
+	for j, served := range s.listeners {
+		if served == l {
+			i = j
+		}
+	}
+	if i < 0 || !s.serving {
+		s.mu.Unlock()
+		return errors.New("manners: RemoveListener called with a listener that isn't being served")
+	}
+	if len(s.listeners) == 1 {
+		s.mu.Unlock()
+		return errors.New("manners: RemoveListener called with the last listener")
+	}
+	s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+	if s.removed == nil {
+		s.removed = make(map[net.Listener]bool)
+	}
+	s.removed[l] = true
+	delete(s.serveFuncs, l)
+	s.mu.Unlock()
+
+	err := l.Close()
+	if err != nil {
+		err = fmt.Errorf("manners: closing listener %v: %w", l.Addr(), err)
+	}
+	fromL := func(tc *trackedConn) bool { return tc.listener == l }
+	s.evictConns(fromL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.countConns(fromL) > 0 {
+		s.connClosed.Wait()
+	}
+	return err
+}
+
+// Serves l with serve and sends the result to acceptErrs. Must be called
+// with s.mu held once Serve has started.
+func (s *GracefulServer) startAccepting(l net.Listener, serve func(net.Listener) error) {
+	s.acceptLoops++
+	if s.serveFuncs == nil {
+		s.serveFuncs = make(map[net.Listener]func(net.Listener) error)
+	}
+	s.serveFuncs[l] = serve
+	errs := s.acceptErrs
+	served := l
+	if s.tracksConns() {
+		served = &servedListener{Listener: l, server: s}
+	}
+	go func() {
+		err := serve(served)
+		s.mu.Lock()
+		if s.removed[l] {
+			err = nil
+		}
+		s.mu.Unlock()
+		errs <- err
+	}()
+}
+
+// A servedListener notes which listener each connection came from, so that
+// RemoveListener can wait for the connections of one listener.
+type servedListener struct {
+	net.Listener
+	server *GracefulServer
+}
+
+func (l *servedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.server.mu.Lock()
+	if l.server.pending == nil {
+		l.server.pending = make(map[net.Conn]net.Listener)
+	}
+	l.server.pending[conn] = l.Listener
+	l.server.mu.Unlock()
+	return conn, nil
+}
+
+// Returns the connection the listener returned for conn, which pending,
+// reservedIP and heldSlots are keyed by: conn itself, unless it is a TLS connection that
+// the inner server set up around it. Only a *tls.Conn is unwrapped, since
+// connections the listener wraps itself, such as a meteredConn, can have a
+// NetConn method too. Must be called with s.mu held.
+func (s *GracefulServer) acceptedConn(conn net.Conn) net.Conn {
+	if _, ok := s.pending[conn]; ok {
+		return conn
+	}
+	if _, ok := s.reservedIP[conn]; ok {
+		return conn
+	}
+	if s.heldSlots[conn] {
+		return conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return conn
+}
+
+// Returns the number of tracked connections that match. Must be called
+// with s.mu held.
+func (s *GracefulServer) countConns(match func(*trackedConn) bool) int {
+	n := 0
+	for _, tc := range s.conns {
+		if match(tc) {
+			n++
+		}
+	}
+	for _, tc := range s.hijacked {
+		if match(tc) {
+			n++
+		}
+	}
+	return n
+}
+
+// Closes the server's listeners so that it stops accepting connections.
+// Equivalent to passing a value to the Shutdown channel, except that it
+// doesn't block and it is safe to call more than once. If Serve has not been
+// called yet, the listener is closed as soon as it is. Returns the errors
+// from closing the listeners, joined with errors.Join, from the call that
+// closed them; later calls, and calls that leave the closing to
+// MinDrainDuration, return nil.
+func (s *GracefulServer) Close() error {
+	s.init()
+	s.mu.Lock()
+	if !s.closing {
+		s.closing = true
+		// Wake up Serve if it is waiting for an Undrain.
+		s.connClosed.Broadcast()
+		close(s.closed)
+		s.logf("manners: shutting down with %d connections open", len(s.conns))
+		s.emitLocked(EventInitiated, len(s.conns))
+	}
+	s.mu.Unlock()
+	// Other callers wait here, so the hook is done before any of them
+	// closes the listeners.
+	s.initiatedOnce.Do(func() {
+		s.removeReadinessFile()
+		if s.OnShutdownInitiated != nil {
+			s.OnShutdownInitiated()
+		}
+	})
+	if !s.KeepIdleOnShutdown {
+		// This closes the idle HTTP/1 connections as well. Otherwise
+		// serveHTTP marks the responses written from now on instead.
+		s.SetKeepAlivesEnabled(false)
+	}
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		for _, f := range s.onShutdown {
+			go f()
+		}
+		s.mu.Unlock()
+		s.closeDisposable()
+		s.limitActiveWrites()
+		s.enforceDrainDeadlines()
+		if s.MinDrainDuration > 0 {
+			s.logf("manners: serving for another %v before draining", s.MinDrainDuration)
+			time.AfterFunc(s.MinDrainDuration, func() { s.finishClose() })
+			return
+		}
+		err = s.finishClose()
+	})
+	return err
+}
+
+// Registers a function to call when Close is first called, like
+// http.Server.RegisterOnShutdown, for instance to tell WebSocket clients to
+// go away. Each function runs in its own goroutine, after
+// OnShutdownInitiated and before the listeners are closed.
+//
+// Registering on InnerServer directly is deprecated: net/http only runs
+// those functions when the inner server is shut down, which also closes
+// its idle connections. So they run once the listeners are closed, after
+// MinDrainDuration if there is one, or if KeepIdleOnShutdown is set, only
+// once the drain is over.
+func (s *GracefulServer) RegisterOnShutdown(f func()) {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onShutdown = append(s.onShutdown, f)
+}
+
+// Registers a subsystem to drain along with the server. Once Close has been
+// called and the connections have drained or been closed forcibly, Drain is
+// called concurrently on every registered Drainable, with a context that is
+// done when the ShutdownTimeout, counted from the moment the listeners were
+// closed, elapses. ShutdownContext returns their errors, joined with
+// errors.Join, and Serve returns once they have all returned. Registrations
+// are kept by Reset.
+func (s *GracefulServer) RegisterDrainable(d Drainable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainables = append(s.drainables, d)
+}
+
+// Drains the subsystems registered with RegisterDrainable and closes
+// completed.
+func (s *GracefulServer) drainDrainables() {
+	defer close(s.completed)
+	s.mu.Lock()
+	drainables := s.drainables
+	deadline := s.drainStart.Add(s.ShutdownTimeout)
+	s.mu.Unlock()
+	if len(drainables) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if s.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	errs := make([]error, len(drainables))
+	var wg sync.WaitGroup
+	for i, d := range drainables {
+		wg.Add(1)
+		go func(i int, d Drainable) {
+			defer wg.Done()
+			errs[i] = d.Drain(ctx)
+		}(i, d)
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if err != nil {
+		s.logf("manners: error draining: %v", err)
+	}
+	s.mu.Lock()
+	s.drainablesErr = err
+	s.mu.Unlock()
+}
+
+// Sets the ActiveDrainTimeout write deadline on every active connection.
+func (s *GracefulServer) limitActiveWrites() {
+	if s.ActiveDrainTimeout <= 0 {
+		return
+	}
+	s.mu.Lock()
+	var active []net.Conn
+	for conn, tc := range s.conns {
+		if tc.state == http.StateActive {
+			active = append(active, conn)
+		}
+	}
+	s.mu.Unlock()
+	deadline := time.Now().Add(s.ActiveDrainTimeout)
+	for _, conn := range active {
+		conn.SetWriteDeadline(deadline)
+	}
+}
+
+// Stops accepting connections and starts closing the open ones.
+func (s *GracefulServer) finishClose() error {
+	err := s.Drain()
+	if s.GRPCGracefulStop != nil {
+		go s.GRPCGracefulStop()
+	}
+	if !s.KeepIdleOnShutdown {
+		s.closeIdle()
+	}
+	if atomic.LoadInt64(&s.activeRequests) == 0 {
+		s.closeUnusedConns()
+	}
+	s.applyDrainPolicy()
+	return err
+}
+
+// Starts the timers of the DrainPolicy.
+func (s *GracefulServer) applyDrainPolicy() {
+	s.mu.Lock()
+	drained := s.drained
+	s.mu.Unlock()
+	limits := []struct {
+		timeout time.Duration
+		state   http.ConnState
+	}{
+		{s.DrainPolicy.IdleTimeout, http.StateIdle},
+		{s.DrainPolicy.ActiveTimeout, http.StateActive},
+		{s.DrainPolicy.HijackedTimeout, http.StateHijacked},
+	}
+	for _, limit := range limits {
+		if limit.timeout <= 0 {
+			continue
+		}
+		state := limit.state
+		time.AfterFunc(limit.timeout, func() {
+			select {
+			case <-drained:
+				// Nothing is left, and the server may have been Reset.
+				return
+			default:
+			}
+			conns := s.takeConns(func(tc *trackedConn) bool { return tc.state == state })
+			if len(conns) == 0 {
+				return
+			}
+			s.logf("manners: drain policy timeout elapsed, closing %d %v connections", len(conns), state)
+			s.closeTaken(conns)
+			s.releaseTaken(len(conns))
+		})
+	}
+}
+
+// Controls whether the inner server keeps HTTP/1 connections alive between
+// requests. Disabling them closes the idle connections as well. Close
+// disables keep-alives unless KeepIdleOnShutdown is set, in which case it
+// adds Connection: close to the responses it writes from then on, so that
+// either way their clients don't reuse the connection.
+func (s *GracefulServer) SetKeepAlivesEnabled(v bool) {
+	s.InnerServer.SetKeepAlivesEnabled(v)
+}
+
+// Closes the server's listeners but keeps serving the connections that are
+// already open, including idle keep-alive connections, until their clients
+// close them. Unlike Close, it doesn't commit the server to shutting down:
+// the process keeps running, and Close may still be called later on. Serve
+// returns once the remaining connections are gone. Returns the errors from
+// closing the listeners, like Close. With a MaintenanceHandler, the
+// listeners stay open and the handler takes over instead, until Close.
+func (s *GracefulServer) Drain() error {
+	s.init()
+	s.mu.Lock()
+	// Close has removed the readiness file already.
+	removeReady := !s.draining && !s.closing
+	if !s.draining {
+		s.draining = true
+		if s.MaintenanceHandler != nil && !s.closing {
+			s.logf("manners: serving the maintenance handler")
+		}
+	}
+	closeListeners := s.closesListeners()
+	if closeListeners && s.drainStart.IsZero() {
+		s.drainStart = time.Now()
+		s.logf("manners: no longer accepting connections")
+		s.emitLocked(EventListenerClosed, len(s.listeners))
+	}
+	s.mu.Unlock()
+	if removeReady {
+		s.removeReadinessFile()
+	}
+	if !closeListeners {
+		atomic.StoreInt32(&s.maintenance, 1)
+		return nil
+	}
+	return s.closeListeners()
+}
+
+// Undoes Drain, for instance to put a server that was taken out of service
+// back in: the listeners Drain closed are bound again to the same addresses,
+// and the server resumes accepting connections. A Unix socket served with
+// ListenAndServeUnix gets its mode again, and a listener from
+// NewChanListener accepts from the same channel again. With a MaintenanceHandler,
+// the regular handler takes over again. Returns an error if the server
+// isn't draining, if Close has been called, which can't be undone, or if
+// Serve has returned already because the drain was over. If an address
+// can't be bound again, for instance because another process took it,
+// returns that error and leaves the server drained.
+func (s *GracefulServer) Undrain() error {
+	s.init()
+	s.mu.Lock()
+	if err := s.checkUndrain(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	closed := !s.drainStart.IsZero()
+	old := append([]net.Listener(nil), s.listeners...)
+	s.mu.Unlock()
+
+	var listeners []net.Listener
+	if closed {
+		for _, l := range old {
+			nl, err := s.rebind(l)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return err
+			}
+			listeners = append(listeners, nl)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkUndrain(); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	s.draining = false
+	atomic.StoreInt32(&s.maintenance, 0)
+	if closed {
+		s.drainStart = time.Time{}
+		s.listeners = listeners
+		if gl, ok := listeners[0].(*GracefulListener); ok {
+			s.listener = gl
+		}
+		for i, l := range listeners {
+			serve, ok := s.serveFuncs[old[i]]
+			if !ok {
+				serve = s.serveListener
+			}
+			delete(s.serveFuncs, old[i])
+			s.startAccepting(l, serve)
+		}
+		s.connClosed.Broadcast()
+	}
+	s.createReadinessFile()
+	s.logf("manners: accepting connections again")
+	return nil
+}
+
+// Returns why Undrain can't be called now, if it can't. Must be called with
+// s.mu held.
+func (s *GracefulServer) checkUndrain() error {
+	switch {
+	case s.closing:
+		return errors.New("manners: Undrain called after Close")
+	case !s.draining:
+		return errors.New("manners: Undrain called on a server that isn't draining")
+	case !s.serving || s.stopped:
+		return errors.New("manners: Undrain called on a server that isn't serving")
+	}
+	return nil
+}
+
+// Binds a new listener to the address of l, which has been closed, wrapped
+// in a GracefulListener if l was one. A Unix socket gets the mode
+// ListenAndServeUnix gave it, if it was served that way, and a listener
+// from NewChanListener is replaced by one accepting from the same channel.
+func (s *GracefulServer) rebind(l net.Listener) (net.Listener, error) {
+	inner := l
+	if gl, ok := l.(*GracefulListener); ok {
+		inner = gl.Listener
+	}
+	addr := l.Addr()
+	var nl net.Listener
+	var err error
+	if cl, ok := inner.(*chanListener); ok {
+		// The caller still holds the sending end of the channel.
+		nl = &chanListener{conns: cl.conns, done: make(chan struct{})}
+	} else {
+		switch addr.Network() {
+		case "tcp":
+			nl, err = s.listen(addr.String())
+		case "unix":
+			nl, err = s.listenUnix(addr.String())
+		default:
+			nl, err = net.Listen(addr.Network(), addr.String())
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("manners: binding %v again: %w", addr, err)
+	}
+	if _, ok := l.(*GracefulListener); ok {
+		nl = NewListener(nl, s)
+	}
+	return nl, nil
+}
+
+// Listens on the Unix socket at path again for rebind, with the mode
+// ListenAndServeUnix gave it, if any.
+func (s *GracefulServer) listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	s.mu.Lock()
+	mode, ok := s.unixModes[path]
+	s.mu.Unlock()
+	if ok {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Called by Serve once it has stopped accepting connections. If the server
+// was drained rather than closed, waits for the connections to finish or
+// for Undrain to resume accepting, and reports whether Undrain did.
+func (s *GracefulServer) awaitUndrain(failed bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !failed && s.acceptLoops == 0 && !s.closing && s.liveConns() > 0 {
+		s.connClosed.Wait()
+	}
+	if s.acceptLoops > 0 {
+		return true
+	}
+	s.stopped = true
+	return false
+}
+
+// Reports whether the listeners are to be closed, because the server is
+// draining without a MaintenanceHandler or is shutting down. Must be called
+// with s.mu held.
+func (s *GracefulServer) closesListeners() bool {
+	return s.draining && (s.MaintenanceHandler == nil || s.closing)
+}
+
+func (s *GracefulServer) closeListeners() error {
+	s.mu.Lock()
+	listeners := append([]net.Listener(nil), s.listeners...)
+	s.mu.Unlock()
+	var errs []error
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			s.logf("manners: error closing listener %v: %v", l.Addr(), err)
+			errs = append(errs, fmt.Errorf("manners: closing listener %v: %w", l.Addr(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Reports whether the server has stopped accepting connections because
+// Drain or Close was called. A health check can use it to report that the
+// server is no longer ready.
+func (s *GracefulServer) IsDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Creates the ReadinessFile, if any.
+func (s *GracefulServer) createReadinessFile() {
+	if s.ReadinessFile == "" {
+		return
+	}
+	if err := os.WriteFile(s.ReadinessFile, nil, 0644); err != nil {
+		s.logf("manners: error creating readiness file: %v", err)
+	}
+}
+
+// Removes the ReadinessFile, if any, unless it is gone already.
+func (s *GracefulServer) removeReadinessFile() {
+	if s.ReadinessFile == "" {
+		return
+	}
+	if err := os.Remove(s.ReadinessFile); err != nil && !os.IsNotExist(err) {
+		s.logf("manners: error removing readiness file: %v", err)
+	}
+}
+
+// Returns a handler for readiness probes, such as a Kubernetes
+// readinessProbe. It responds 200 OK until Close or Drain is called, and
+// 503 Service Unavailable from then on, including during MinDrainDuration,
+// so that the load balancer stops sending traffic.
+func (s *GracefulServer) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		ready := !s.closing && !s.draining
+		s.mu.Unlock()
+		if !ready {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Shuts the inner server down without waiting for it. This closes the idle
+// connections, makes busy HTTP/1 connections close once their response is
+// written, and sends HTTP/2 clients a GOAWAY so that their connections close
+// after the last stream has finished. Closing an HTTP/2 connection as soon as
+// it reports StateIdle instead could cut off a response that is still being
+// flushed.
+func (s *GracefulServer) closeIdle() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.InnerServer.Shutdown(ctx)
+}
+
+// Closes the server and waits for the in-flight requests to finish, or for
+// Serve to close the remaining connections when ShutdownTimeout elapses.
+// Returns true if the server drained cleanly. It may be called from several
+// goroutines at once, and again after the drain; every caller returns once
+// the one drain is over. If Serve hasn't been called, there is nothing to
+// drain and it returns true right away.
+func (s *GracefulServer) BlockingClose() bool {
+	return s.BlockingCloseWithTimeout(0)
+}
+
+// Closes the server and waits up to d for the in-flight requests to finish.
+// Connections that are still open when d elapses are closed forcibly.
+// Returns false if that happened, true if the server drained cleanly. A
+// non-positive d waits forever. Like BlockingClose, it returns true right
+// away if Serve hasn't been called.
+func (s *GracefulServer) BlockingCloseWithTimeout(d time.Duration) bool {
+	drained, _ := s.BlockingCloseTimeout(d)
+	return drained
+}
+
+// Like BlockingCloseWithTimeout, but also returns the number of connections
+// that were still open when the timeout elapsed and were closed forcibly
+// because of it, for logging and alerting. The connections are counted as
+// they are taken to be closed, so none that finishes in the meantime is
+// counted. If ShutdownTimeout elapsed first, remaining is the number of
+// connections it cut off. remaining is 0 if drained is true.
+func (s *GracefulServer) BlockingCloseTimeout(d time.Duration) (drained bool, remaining int) {
+	s.init()
+	s.Close()
+	return s.awaitDrain(d)
+}
+
+// Closes the server and gives the in-flight requests up to d to finish,
+// for a signal handler that wants to shut down in one call. Connections
+// still open after d are closed forcibly, as with BlockingCloseWithTimeout,
+// except that a non-positive d closes them right away rather than waiting
+// forever; routines started with StartRoutine or Go are still waited for.
+// Returns true if the server drained without closing any connection.
+func (s *GracefulServer) CloseWithin(d time.Duration) bool {
+	s.init()
+	s.Close()
+	if d <= 0 && s.ConnectionCount() > 0 {
+		s.forceClose()
+	}
+	drained, _ := s.awaitDrain(d)
+	return drained
+}
+
+// Closes the server and waits for the in-flight requests to finish, in the
+// manner of http.Server.Shutdown. Returns once the server has drained, or
+// ctx.Err() if the context is done first. If any Drainable is registered,
+// it also waits for them, and returns their errors. Connections are not
+// closed forcibly when the context expires; Serve keeps waiting for them
+// subject to ShutdownTimeout. Returns nil right away if Serve hasn't been
+// called. (The name Shutdown is taken by the channel.)
+func (s *GracefulServer) ShutdownContext(ctx context.Context) error {
+	s.init()
+	s.Close()
+	if !s.hasServed() {
+		return nil
+	}
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.mu.Lock()
+	completed := s.completed
+	wait := len(s.drainables) > 0
+	s.mu.Unlock()
+	if !wait {
+		return nil
+	}
+	select {
+	case <-completed:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.drainablesErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Blocks until Serve has returned, and returns the outcome of the shutdown,
+// like errgroup.Group.Wait: nil if the server drained cleanly, an error
+// wrapping both ErrServerClosed and context.DeadlineExceeded if the
+// ShutdownTimeout or the timeout of BlockingCloseWithTimeout and the like
+// cut connections off, or the error Serve failed with otherwise. If
+// ListenAndServe or one of the other ListenAndServe methods fails before
+// it serves, for instance because it can't bind its address, Wait returns
+// that error instead. Every caller gets the same result.
+func (s *GracefulServer) Wait() error {
+	s.init()
+	s.mu.Lock()
+	exited := s.exited
+	s.mu.Unlock()
+	<-exited
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exitErr
+}
+
+// Returns a channel that is closed once the server has been closed and every
+// connection and routine it was waiting for has finished or, for the
+// connections, been closed forcibly. It stays open for as long as the server
+// keeps serving.
+func (s *GracefulServer) Done() <-chan struct{} {
+	s.init()
+	return s.drained
+}
+
+// Prepares a server that has been closed and has fully drained to be served
+// again, as if it had just been created: it can be passed to Serve, closed
+// and drained once more. InnerServer, which can't serve again once it has
+// been shut down, is replaced by a new http.Server with the same settings.
+// Hooks registered with RegisterOnShutdown and the totals reported by the
+// metrics are kept. Reset must only be called once Done is closed and Serve
+// has returned, never while the server is shutting down, and not
+// concurrently with any other method; it returns an error if the server
+// hasn't drained yet.
+func (s *GracefulServer) Reset() error {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.drained:
+	default:
+		return errors.New("manners: Reset called before the server drained")
+	}
+
+	s.InnerServer.TLSConfig = s.callerTLSConfig()
+	s.InnerServer = serverConfig(&s.InnerServer)
+	s.InnerServer.TLSNextProto = s.tlsNextProto
+	s.InnerServer.ConnContext = s.connContext
+	s.tickets = nil
+	s.tlsConfig = nil
+	s.derivedTLSConfig = nil
+
+	s.listeners = nil
+	s.serveListener = nil
+	s.serveFuncs = nil
+	s.acceptLoops = 0
+	s.acceptErrs = nil
+	s.stopped = false
+	s.removed = nil
+	s.unixModes = nil
+	s.pending = nil
+	s.cancels = nil
+	s.connsPerIP = nil
+	s.reservedIP = nil
+	s.reservedConns = 0
+	s.heldSlots = nil
+	atomic.StoreInt32(&s.slotsHeld, 0)
+	s.proxied = nil
+	s.serving = false
+	s.draining = false
+	s.closing = false
+	s.listener = nil
+	s.addr = nil
+	s.signals = nil
+	s.drainStart = time.Time{}
+	s.drainDuration = 0
+	s.timedOut = 0
+	if s.eventsClosed {
+		s.events = make(chan ShutdownEvent, eventBuffer)
+		s.eventsRead = false
+		s.eventsClosed = false
+	}
+	atomic.StoreInt32(&s.maintenance, 0)
+	s.closed = make(chan struct{})
+	s.listening = make(chan struct{})
+	s.drained = make(chan struct{})
+	s.forced = make(chan struct{})
+	s.completed = make(chan struct{})
+	s.exited = make(chan struct{})
+	s.serveErr = nil
+	s.exitErr = nil
+	s.drainablesErr = nil
+	s.forceOnce = sync.Once{}
+	s.initiatedOnce = sync.Once{}
+	s.closeOnce = sync.Once{}
+	return nil
+}
+
+// Returns a server with the settings of srv, but none of its state. HTTP2
+// and Protocols are left out so that this builds on Go 1.22.
+func serverConfig(srv *http.Server) http.Server {
+	return http.Server{
+		Addr:                         srv.Addr,
+		Handler:                      srv.Handler,
+		DisableGeneralOptionsHandler: srv.DisableGeneralOptionsHandler,
+		TLSConfig:                    srv.TLSConfig,
+		ReadTimeout:                  srv.ReadTimeout,
+		ReadHeaderTimeout:            srv.ReadHeaderTimeout,
+		WriteTimeout:                 srv.WriteTimeout,
+		IdleTimeout:                  srv.IdleTimeout,
+		MaxHeaderBytes:               srv.MaxHeaderBytes,
+		TLSNextProto:                 srv.TLSNextProto,
+		ConnState:                    srv.ConnState,
+		ErrorLog:                     srv.ErrorLog,
+		BaseContext:                  srv.BaseContext,
+		ConnContext:                  srv.ConnContext,
+	}
+}
+
+// Returns the number of connections the server is currently tracking, that
+// is, connections that are new, active or idle, and hijacked connections if
+// TrackHijacked is set. It is cheap enough to be polled.
+func (s *GracefulServer) ConnectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.liveConns()
+}
+
+// Waits until no connections are open, as counted by ConnectionCount, or
+// until ctx is done, in which case it returns ctx.Err(). Unlike
+// ShutdownContext it doesn't close anything, so new connections are still
+// accepted unless Drain was called.
+func (s *GracefulServer) WaitForZeroConnections(ctx context.Context) error {
+	s.init()
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.connClosed.Broadcast()
+	})
+	defer stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.liveConns() > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.connClosed.Wait()
+	}
+	return nil
+}
+
+// Returns the hijacked connections the server is waiting for, as they were
+// handed to the handlers. It is empty unless TrackHijacked is set. An
+// application can use it to tell its WebSocket clients to reconnect
+// elsewhere before they are cut off.
+func (s *GracefulServer) HijackedConnections() []net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]net.Conn, 0, len(s.hijacked))
+	for _, tc := range s.hijacked {
+		conns = append(conns, tc.conn)
+	}
+	return conns
+}
+
+// Reports whether conn counts towards ConnectionCount and so holds up a
+// drain. conn is a connection as the inner server or a handler sees it,
+// such as one returned by http.Hijacker.
+func (s *GracefulServer) IsTracked(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		return true
+	}
+	_, ok := s.hijacked[unwrapConn(conn)]
+	return ok
+}
+
+// Stops counting conn towards ConnectionCount, as though it had been closed,
+// so that it no longer holds up a drain. A handler that hijacks a
+// connection tracked because of TrackHijacked and hands it elsewhere can use
+// it to release the connection without closing it. It does nothing if conn
+// isn't tracked.
+func (s *GracefulServer) MarkClosed(conn net.Conn) {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.releaseConn(conn)
+		return
+	}
+	if gc := unwrapConn(conn); gc != nil {
+		if tc, ok := s.hijacked[gc]; ok {
+			delete(s.hijacked, gc)
+			s.uncountIP(tc)
+			s.connDone()
+		}
+	}
+}
+
+// Marks the connection r arrived on as disposable: instead of being waited
+// for, it is closed as soon as the server is closed, or right away if the
+// server is already shutting down. Meant for handlers that never finish on
+// their own, such as server-sent event streams and long polls, which should
+// return once their request's context is done. For HTTP/2 this closes the
+// connection with all of its streams. It does nothing if r wasn't received
+// by a GracefulServer.
+func MarkDisposable(r *http.Request) {
+	s, _ := r.Context().Value(serverContextKey{}).(*GracefulServer)
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if s == nil || conn == nil {
+		return
+	}
+	s.mu.Lock()
+	tc, ok := s.conns[conn]
+	if !ok {
+		if gc := unwrapConn(conn); gc != nil {
+			tc, ok = s.hijacked[gc]
+		}
+	}
+	if ok {
+		tc.disposable = true
+	}
+	closing := s.closing
+	s.mu.Unlock()
+	if ok && closing {
+		s.closeDisposable()
+	}
+}
+
+// Sets how long the server may wait for r during a drain: if r's connection
+// is still busy at t once the server is closed, the connection is closed
+// forcibly, as though ShutdownTimeout had elapsed for it alone. This way a
+// request that declares its own deadline, in a header for instance, is
+// waited for no longer than it needs even if ShutdownTimeout is more
+// generous, while ShutdownTimeout still applies if it elapses first. If the
+// connection carries several requests, as with HTTP/2, the earliest
+// deadline applies until all of them are done. It does nothing if r wasn't
+// received by a GracefulServer.
+func SetDrainDeadline(r *http.Request, t time.Time) {
+	s, _ := r.Context().Value(serverContextKey{}).(*GracefulServer)
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if s == nil || conn == nil {
+		return
+	}
+	s.mu.Lock()
+	tc, ok := s.conns[conn]
+	if !ok {
+		if gc := unwrapConn(conn); gc != nil {
+			tc, ok = s.hijacked[gc]
+		}
+	}
+	if ok && (tc.drainDeadline.IsZero() || t.Before(tc.drainDeadline)) {
+		tc.drainDeadline = t
+	}
+	closing := s.closing
+	drained := s.drained
+	s.mu.Unlock()
+	if ok && closing {
+		s.enforceDrainDeadline(tc, t, drained)
+	}
+}
+
+// Schedules the connections given a deadline by SetDrainDeadline to be
+// closed once it passes.
+func (s *GracefulServer) enforceDrainDeadlines() {
+	s.mu.Lock()
+	drained := s.drained
+	deadlines := make(map[*trackedConn]time.Time)
+	for _, tc := range s.conns {
+		if !tc.drainDeadline.IsZero() {
+			deadlines[tc] = tc.drainDeadline
+		}
+	}
+	for _, tc := range s.hijacked {
+		if !tc.drainDeadline.IsZero() {
+			deadlines[tc] = tc.drainDeadline
+		}
+	}
+	s.mu.Unlock()
+	for tc, t := range deadlines {
+		s.enforceDrainDeadline(tc, t, drained)
+	}
+}
+
+// Closes tc forcibly at t, unless it is gone or no longer has a deadline
+// that has passed by then.
+func (s *GracefulServer) enforceDrainDeadline(tc *trackedConn, t time.Time, drained chan struct{}) {
+	time.AfterFunc(time.Until(t), func() {
+		select {
+		case <-drained:
+			// Nothing is left, and the server may have been Reset.
+			return
+		default:
+		}
+		now := time.Now()
+		conns := s.takeConns(func(c *trackedConn) bool {
+			return c == tc && !c.drainDeadline.IsZero() && !now.Before(c.drainDeadline)
+		})
+		if len(conns) == 0 {
+			return
+		}
+		s.logf("manners: drain deadline passed, closing connection from %v", conns[0].conn.RemoteAddr())
+		s.closeTaken(conns)
+		s.releaseTaken(len(conns))
+	})
+}
+
+// Closes and releases the connections marked by MarkDisposable.
+func (s *GracefulServer) closeDisposable() {
+	s.closeGracefully(s.takeConns(func(tc *trackedConn) bool { return tc.disposable }))
+}
+
+// Closes connections returned by takeConns and releases them as having
+// drained.
+func (s *GracefulServer) closeGracefully(conns []*trackedConn) {
+	for _, tc := range conns {
+		tc.conn.Close()
+	}
+	s.mu.Lock()
+	for range conns {
+		s.connDone()
+	}
+	s.mu.Unlock()
+}
+
+// Describes an open connection; see ConnectionStats.
+type ConnInfo struct {
+	// Nil for a new connection whose PROXY protocol header has not been
+	// read yet.
+	RemoteAddr net.Addr
+
+	// How long ago the connection was accepted.
+	Age time.Duration
+
+	// http.StateHijacked for a hijacked connection tracked because of
+	// TrackHijacked.
+	State http.ConnState
+
+	// The number of requests served on the connection so far, not counting
+	// one in progress.
+	Requests int
+
+	// The Host of the first request on the connection, and the server name
+	// the client asked for in its TLS handshake. Empty until the first
+	// request has arrived.
+	Host       string
+	ServerName string
+
+	// The number of bytes read from and written to the connection so far,
+	// including TLS records and PROXY protocol headers, and when it last
+	// read or wrote any, or was accepted if it hasn't yet. A connection
+	// that holds up a drain without recent activity is likely an idle one
+	// that could be closed. Zero unless CountBytes is set.
+	BytesRead    uint64
+	BytesWritten uint64
+	LastActivity time.Time
+}
+
+// Closes the connections whose ConnInfo matches pred and leaves the others
+// serving, for instance to move one tenant's clients elsewhere. Idle and
+// hijacked connections are closed right away. A busy HTTP/1 connection is
+// closed once its request has finished. A busy HTTP/2 connection answers its
+// next request with a GOAWAY, after which the client closes it. pred is
+// called with the server's lock held, so it must not call the server. Returns
+// the number of connections that matched.
+func (s *GracefulServer) DrainMatching(pred func(ConnInfo) bool) int {
+	s.init()
+	now := time.Now()
+	return s.evictConns(func(tc *trackedConn) bool { return pred(tc.info(now)) })
+}
+
+// Closes the connections that match as DrainMatching does, and returns the
+// number that matched. match is called with s.mu held.
+func (s *GracefulServer) evictConns(match func(*trackedConn) bool) int {
+	s.mu.Lock()
+	var closing []net.Conn
+	matched := 0
+	for conn, tc := range s.conns {
+		if !match(tc) {
+			continue
+		}
+		matched++
+		tc.evict = true
+		if tc.state == http.StateIdle {
+			closing = append(closing, conn)
+		}
+	}
+	for _, tc := range s.hijacked {
+		if match(tc) {
+			closing = append(closing, tc.conn)
+			matched++
+		}
+	}
+	s.mu.Unlock()
+	for _, conn := range closing {
+		conn.Close()
+	}
+	return matched
+}
+
+// Returns the most connections that have been open at once, as counted by
+// ConnectionCount, since the server was created or ResetPeakConnections was
+// last called, for sizing MaxConnections and file descriptor limits.
+func (s *GracefulServer) PeakConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peakConns
+}
+
+// Returns PeakConnections and starts over from the connections open now,
+// for reporting the peak of each period.
+func (s *GracefulServer) ResetPeakConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peak := s.peakConns
+	s.peakConns = s.liveConns()
+	return peak
+}
+
+// Describes every connection that ConnectionCount counts, for instance to
+// find out from an admin endpoint what is holding up a drain.
+func (s *GracefulServer) ConnectionStats() []ConnInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	stats := make([]ConnInfo, 0, s.liveConns())
+	for _, tc := range s.conns {
+		stats = append(stats, tc.info(now))
+	}
+	for _, tc := range s.hijacked {
+		stats = append(stats, tc.info(now))
+	}
+	return stats
+}
+
+// Increments the server's WaitGroup. Use this if a web request starts more
+// goroutines and these goroutines are not guaranteed to finish before the
+// request.
+func (s *GracefulServer) StartRoutine() {
+	s.wg.Add(1)
+}
+
+// Decrement the server's WaitGroup. Used this to complement StartRoutine().
+func (s *GracefulServer) FinishRoutine() {
+	s.wg.Done()
+}
+
+// Runs f in a new goroutine that the server waits for when it drains, like
+// a connection, for background work started by a handler such as writing an
+// audit log. Work is accepted for as long as the server accepts
+// connections, including during MinDrainDuration. Once the listeners are
+// closed and every connection is gone, nothing may be added to the drain
+// any more, even if goroutines started earlier are still running: f is
+// then not run, and Go returns false. That doesn't happen to a handler
+// calling Go, whose own connection is still open, unless the connection
+// has been closed forcibly.
+func (s *GracefulServer) Go(f func()) bool {
+	s.mu.Lock()
+	if s.drainOver() {
+		s.mu.Unlock()
+		return false
+	}
+	s.StartRoutine()
+	s.mu.Unlock()
+	go func() {
+		defer s.FinishRoutine()
+		f()
+	}()
+	return true
+}
+
+// Reports whether a draining server has nothing left to wait for, so that
+// nothing may be added to the drain any more. A server that is still
+// accepting connections, during MinDrainDuration or when Drain leaves the
+// listeners to a MaintenanceHandler, is not there yet. Must be called with
+// s.mu held.
+func (s *GracefulServer) drainOver() bool {
+	return s.closesListeners() && s.liveConns() == 0 && s.trackedRequests == 0
+}
+
+// Returns a handler that counts every request passed to h as part of the
+// drain, like a connection, for requests that reach it without going
+// through Serve's handler. An HTTP/2 stream served through h2c, as gRPC
+// over cleartext HTTP/2 usually is, is one: h2c hijacks the connection and
+// serves its streams itself, so the drain would otherwise wait for
+// connections that may never close, or with TrackHijacked false, for none
+// of the streams at all. A request is refused with 503 Service Unavailable
+// only once the drain is over, when the listeners are closed and no
+// connection or tracked request is left, as with Go. Requests going through Serve's
+// handler are counted already and shouldn't be wrapped.
+func (s *GracefulServer) TrackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		if s.drainOver() {
+			s.mu.Unlock()
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		s.trackedRequests++
+		s.StartRoutine()
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.trackedRequests--
+			s.FinishRoutine()
+			s.mu.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Closes the server when stop is closed or receives a value, for services
+// that broadcast their shutdown on a channel, such as a context's Done
+// channel. The goroutine waiting on stop exits once the server is closed,
+// whatever closed it.
+func (s *GracefulServer) CloseOnChannel(stop <-chan struct{}) {
+	s.init()
+	closed := s.closed
+	go func() {
+		select {
+		case <-stop:
+			s.Close()
+		case <-closed:
+		}
+	}()
+}
+
+func (s *GracefulServer) listenForShutdown() {
+	closed := s.closed
+	go func() {
+		select {
+		case <-s.Shutdown:
+			s.Close()
+		case <-closed:
+		}
+	}()
+}
+
+// Records a connection while it is open so that it can be closed forcibly
+// if the shutdown timeout elapses. Only connections that were counted on
+// StateNew are released again, so a forcibly closed connection reporting
+// StateClosed later on cannot drive the WaitGroup negative.
+func (s *GracefulServer) trackConnState(conn net.Conn, newState http.ConnState) {
+	if s.updateConnState(conn, newState) {
+		conn.Close()
+	}
+	if s.StateChanged != nil {
+		s.StateChanged(conn, newState)
+	}
+}
+
+// Counts a connection on StateNew and releases it once it is closed or
+// hijacked, for CountOnly.
+func (s *GracefulServer) countConnState(conn net.Conn, newState http.ConnState) {
+	switch newState {
+	case http.StateNew:
+		atomic.AddUint64(&s.acceptedCount, 1)
+		atomic.AddInt64(&s.countedConns, 1)
+		s.StartRoutine()
+		// The listener has held the connection's slot, if any, before
+		// returning it, so without any held the lock can be skipped.
+		if atomic.LoadInt32(&s.slotsHeld) > 0 {
+			s.mu.Lock()
+			s.takeSlot(s.acceptedConn(conn))
+			s.mu.Unlock()
+		}
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&s.countedConns, -1)
+		s.mu.Lock()
+		s.connDone()
+		s.mu.Unlock()
+	}
+	if s.StateChanged != nil {
+		s.StateChanged(conn, newState)
+	}
+}
+
+// Reports whether the server keeps a record of each connection.
+func (s *GracefulServer) tracksConns() bool {
+	return !s.DisableTracking && !s.CountOnly
+}
+
+// Reports whether the connection has become idle after DrainMatching
+// selected it, and should be closed.
+func (s *GracefulServer) updateConnState(conn net.Conn, newState http.ConnState) (evict bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch newState {
+	case http.StateNew:
+		atomic.AddUint64(&s.acceptedCount, 1)
+		s.StartRoutine()
+		now := time.Now()
+		tc := &trackedConn{conn: conn, state: newState, created: now, changed: now, counter: unwrapMeteredConn(conn)}
+		if !s.ProxyProtocol {
+			tc.remoteAddr = conn.RemoteAddr()
+		}
+		accepted := s.acceptedConn(conn)
+		tc.listener = s.pending[accepted]
+		delete(s.pending, accepted)
+		tc.cancel = s.cancels[conn]
+		delete(s.cancels, conn)
+		s.conns[conn] = tc
+		s.countIP(tc, accepted)
+		s.takeSlot(accepted)
+		if n := s.liveConns(); n > s.peakConns {
+			s.peakConns = n
+		}
+	case http.StateActive, http.StateIdle:
+		if tc, ok := s.conns[conn]; ok {
+			if tc.state == http.StateNew {
+				s.endHandshakeTimeout(conn)
+			}
+			if tc.remoteAddr == nil {
+				// The inner server has read the PROXY protocol header
+				// by now, so this doesn't block.
+				tc.remoteAddr = conn.RemoteAddr()
+			}
+			if tc.state == http.StateActive && newState == http.StateIdle {
+				tc.requests++
+			}
+			if newState == http.StateIdle {
+				tc.drainDeadline = time.Time{}
+			}
+			if tc.state != newState {
+				tc.changed = time.Now()
+			}
+			tc.state = newState
+			// An HTTP/2 connection can report StateIdle before its last
+			// response is flushed, so it is left to close after a GOAWAY.
+			return newState == http.StateIdle && tc.evict && !isHTTP2(conn)
+		}
+	case http.StateHijacked:
+		if gc := unwrapConn(conn); gc != nil && s.TrackHijacked {
+			// Keep counting it until the handler closes it.
+			if tc, ok := s.conns[conn]; ok {
+				delete(s.conns, conn)
+				tc.state = newState
+				s.hijacked[gc] = tc
+			}
+			return false
+		}
+		if tc, ok := s.conns[conn]; ok && tc.cancel != nil {
+			// Cancelling it now would cancel the hijacking handler's
+			// request context, so leave that to serveHTTP.
+			s.cancels[conn] = tc.cancel
+			tc.cancel = nil
+		}
+		s.releaseConn(conn)
+	case http.StateClosed:
+		s.releaseConn(conn)
+	}
+	return false
+}
+
+// Lifts the HandshakeTimeout deadline from a connection that has left
+// StateNew. For HTTP/1 the inner server has already replaced it while
+// reading the first request. Recent versions of net/http clear it for
+// HTTP/2 as well, but an HTTP/2 server installed through TLSNextProto
+// doesn't.
+func (s *GracefulServer) endHandshakeTimeout(conn net.Conn) {
+	if s.HandshakeTimeout <= 0 {
+		return
+	}
+	if isHTTP2(conn) {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Reports whether conn negotiated HTTP/2 in its TLS handshake.
+func isHTTP2(conn net.Conn) bool {
+	tc, ok := conn.(*tls.Conn)
+	return ok && tc.ConnectionState().NegotiatedProtocol == "h2"
+}
+
+// Must be called with s.mu held.
+func (s *GracefulServer) releaseConn(conn net.Conn) {
+	if tc, ok := s.conns[conn]; ok {
+		delete(s.conns, conn)
+		s.uncountIP(tc)
+		if tc.cancel != nil {
+			tc.cancel()
+		}
+		s.connDone()
+	}
+}
+
+// Called when a gracefulConn is closed. Releases it if it was hijacked.
+func (s *GracefulServer) hijackedClosed(gc *gracefulConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tc, ok := s.hijacked[gc]; ok {
+		delete(s.hijacked, gc)
+		s.uncountIP(tc)
+		if tc.cancel != nil {
+			tc.cancel()
+		}
+		s.connDone()
+	}
+}
+
+// Accounts for a tracked connection that has gone away. Must be called with
+// s.mu held.
+func (s *GracefulServer) connDone() {
+	if s.closing {
+		atomic.AddUint64(&s.drainedCount, 1)
+	}
+	s.FinishRoutine()
+	s.connClosed.Broadcast()
+}
+
+// Returns the number of connections the server is tracking in each state,
+// with the hijacked ones under http.StateHijacked. Every state is listed,
+// even with no connection in it.
+func (s *GracefulServer) ConnectionStates() map[http.ConnState]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := map[http.ConnState]int{
+		http.StateNew:      0,
+		http.StateActive:   0,
+		http.StateIdle:     0,
+		http.StateHijacked: len(s.hijacked),
+	}
+	for _, tc := range s.conns {
+		states[tc.state]++
+	}
+	return states
+}
+
+// The server's record of an open connection.
+type trackedConn struct {
+	conn       net.Conn
+	remoteAddr net.Addr
+	state      http.ConnState
+	created    time.Time
+	changed    time.Time
+	requests   int
+	host       string
+	serverName string
+
+	// The listener the connection was accepted from.
+	listener net.Listener
+
+	// Cancels the connection's context.
+	cancel context.CancelFunc
+
+	// The client IP address the connection counts towards under
+	// MaxConnectionsPerIP, if any, and with ProxyProtocol, the proxyConn
+	// underneath it.
+	ip    string
+	proxy *proxyConn
+
+	// The connection's byte counts, if CountBytes is set.
+	counter *meteredConn
+
+	// Set by DrainMatching for a connection to close once it is idle.
+	evict bool
+
+	// Set by MarkDisposable for a connection to close on shutdown.
+	disposable bool
+
+	// Set by SetDrainDeadline for a connection to close once it passes
+	// during the drain. Cleared when the connection becomes idle.
+	drainDeadline time.Time
+}
+
+func (tc *trackedConn) info(now time.Time) ConnInfo {
+	info := ConnInfo{
+		RemoteAddr: tc.remoteAddr,
+		Age:        now.Sub(tc.created),
+		State:      tc.state,
+		Requests:   tc.requests,
+		Host:       tc.host,
+		ServerName: tc.serverName,
+	}
+	if c := tc.counter; c != nil {
+		info.BytesRead = atomic.LoadUint64(&c.bytesRead)
+		info.BytesWritten = atomic.LoadUint64(&c.bytesWritten)
+		info.LastActivity = time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	}
+	return info
+}
+
+// Must be called with s.mu held.
+func (s *GracefulServer) liveConns() int {
+	return len(s.conns) + len(s.hijacked) + int(atomic.LoadInt64(&s.countedConns))
+}
+
+// Applies the TCP options to a newly accepted TCP connection.
+func (s *GracefulServer) setTCPOptions(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if s.TCPNoDelay != nil {
+		tc.SetNoDelay(*s.TCPNoDelay)
+	}
+	switch {
+	case s.KeepAlivePeriod < 0:
+		tc.SetKeepAlive(false)
+	case s.KeepAlivePeriod > 0:
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(s.KeepAlivePeriod)
+	}
+}
+
+// Blocks until the server has room for another connection under
+// MaxConnections, and reserves it in the same critical section, so that
+// listeners accepting at once can't all take the last one. Reports whether
+// a slot was reserved, which the listener passes on to the connection it
+// returns with holdSlot, or gives back with releaseSlot if it returns none;
+// ok is false if the listener is closed in the meantime.
+func (s *GracefulServer) waitForCapacity(l *GracefulListener) (reserved, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.MaxConnections > 0 && s.liveConns()+s.reservedConns >= s.MaxConnections {
+		if !l.isOpen() {
+			return false, false
+		}
+		s.connClosed.Wait()
+	}
+	// Without tracking, connections are never counted.
+	if s.MaxConnections <= 0 || s.DisableTracking {
+		return false, true
+	}
+	s.reservedConns++
+	return true, true
+}
+
+// Records that conn, about to be returned by a listener, holds the slot
+// that waitForCapacity reserved, until takeSlot takes it over.
+func (s *GracefulServer) holdSlot(conn net.Conn, reserved bool) {
+	if !reserved {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.heldSlots == nil {
+		s.heldSlots = make(map[net.Conn]bool)
+	}
+	s.heldSlots[conn] = true
+	atomic.AddInt32(&s.slotsHeld, 1)
+}
+
+// Gives back a slot that waitForCapacity reserved for a connection the
+// listener then failed to accept or turned away.
+func (s *GracefulServer) releaseSlot(reserved bool) {
+	if !reserved {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reservedConns--
+	s.connClosed.Broadcast()
+}
+
+// Takes over the slot the listener reserved for a newly counted connection
+// as accepted, if any, now that it counts towards MaxConnections itself.
+// Must be called with s.mu held.
+func (s *GracefulServer) takeSlot(accepted net.Conn) {
+	if s.heldSlots[accepted] {
+		delete(s.heldSlots, accepted)
+		atomic.AddInt32(&s.slotsHeld, -1)
+		s.reservedConns--
+	}
+}
+
+// Returns the IP address of addr for MaxConnectionsPerIP, or "" if it has
+// none, as for a Unix socket.
+func clientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// Reports whether the listener may hand a newly accepted connection from
+// addr to the inner server under MaxConnectionsPerIP, and if so reserves
+// the connection's slot in the same critical section, so that connections
+// accepted at once by several listeners can't all get in. Returns the IP
+// address the slot was taken for, or "" if none was needed. The listener
+// passes the slot on to the connection it returns with holdIP, and gives
+// it back with releaseIP if it turns the connection away instead.
+func (s *GracefulServer) admitIP(addr net.Addr) (string, bool) {
+	// Without tracking, connections are never counted.
+	if s.MaxConnectionsPerIP <= 0 || s.ProxyProtocol || !s.tracksConns() {
+		return "", true
+	}
+	ip := clientIP(addr)
+	if ip == "" {
+		return "", true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connsPerIP[ip] >= s.MaxConnectionsPerIP {
+		return "", false
+	}
+	if s.connsPerIP == nil {
+		s.connsPerIP = make(map[string]int)
+	}
+	s.connsPerIP[ip]++
+	return ip, true
+}
+
+// Records that conn, about to be returned by a listener, holds the slot
+// that admitIP reserved for ip, until countIP takes it over.
+func (s *GracefulServer) holdIP(conn net.Conn, ip string) {
+	if ip == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reservedIP == nil {
+		s.reservedIP = make(map[net.Conn]string)
+	}
+	s.reservedIP[conn] = ip
+}
+
+// Gives back a slot that admitIP reserved for ip for a connection the
+// listener then turned away.
+func (s *GracefulServer) releaseIP(ip string) {
+	if ip == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connsPerIP[ip]--; s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// Starts counting a newly tracked connection under MaxConnectionsPerIP,
+// taking over the slot the listener reserved for it as accepted, if any.
+// With ProxyProtocol, this waits for admitProxied. Must be called with
+// s.mu held.
+func (s *GracefulServer) countIP(tc *trackedConn, accepted net.Conn) {
+	if s.MaxConnectionsPerIP <= 0 {
+		return
+	}
+	if ip, ok := s.reservedIP[accepted]; ok {
+		delete(s.reservedIP, accepted)
+		tc.ip = ip
+		return
+	}
+	if s.ProxyProtocol {
+		if tc.proxy = unwrapProxyConn(tc.conn); tc.proxy != nil {
+			if s.proxied == nil {
+				s.proxied = make(map[*proxyConn]*trackedConn)
+			}
+			s.proxied[tc.proxy] = tc
+		}
+		return
+	}
+	if tc.ip = clientIP(tc.conn.RemoteAddr()); tc.ip != "" {
+		if s.connsPerIP == nil {
+			s.connsPerIP = make(map[string]int)
+		}
+		s.connsPerIP[tc.ip]++
+	}
+}
+
+// Stops counting a connection that is no longer tracked under
+// MaxConnectionsPerIP. Must be called with s.mu held.
+func (s *GracefulServer) uncountIP(tc *trackedConn) {
+	if tc.proxy != nil {
+		delete(s.proxied, tc.proxy)
+	}
+	if tc.ip == "" {
+		return
+	}
+	if s.connsPerIP[tc.ip]--; s.connsPerIP[tc.ip] <= 0 {
+		delete(s.connsPerIP, tc.ip)
+	}
+	tc.ip = ""
+}
+
+// Called by a proxyConn once its header has been read, with the client's
+// address from it. Counts the connection under MaxConnectionsPerIP, or stops
+// tracking it and reports false if its client is already at the limit.
+func (s *GracefulServer) admitProxied(pc *proxyConn, addr net.Addr) bool {
+	s.mu.Lock()
+	tc, ok := s.proxied[pc]
+	if !ok {
+		// Already closed forcibly.
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.proxied, pc)
+	tc.proxy = nil
+	ip := clientIP(addr)
+	if ip == "" || s.connsPerIP[ip] < s.MaxConnectionsPerIP {
+		if ip != "" {
+			if s.connsPerIP == nil {
+				s.connsPerIP = make(map[string]int)
+			}
+			s.connsPerIP[ip]++
+			tc.ip = ip
+		}
+		s.mu.Unlock()
+		return true
+	}
+	s.mu.Unlock()
+	s.logf("manners: turning away a connection from %s, which has %d open already", ip, s.MaxConnectionsPerIP)
+	conns := s.takeConns(func(tc *trackedConn) bool { return unwrapProxyConn(tc.conn) == pc })
+	s.releaseTaken(len(conns))
+	return false
+}
+
+// Changes MaxConnections while the server is running, for instance to follow
+// memory pressure. Lowering it below the number of connections open closes
+// none of them: the listener stops accepting until enough have finished.
+// Raising it lets a listener waiting for capacity accept right away.
+func (s *GracefulServer) SetMaxConnections(n int) {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MaxConnections = n
+	s.connClosed.Broadcast()
+}
+
+// Wakes up a listener that is waiting for capacity, so that it notices it
+// has been closed.
+func (s *GracefulServer) listenerClosed() {
+	s.mu.Lock()
+	s.connClosed.Broadcast()
+	s.mu.Unlock()
+}
+
+// Called by Serve once the listener is closed. Blocks until every in-flight
+// request is done or the shutdown timeout has elapsed.
+//
+// Connections are counted on StateNew, which the inner server reports from
+// its accept loop before accepting the next connection. Every accept loop
+// has returned by the time this is called, so no connection can be counted
+// after the WaitGroup is waited on.
+func (s *GracefulServer) waitForDrain() {
+	go func() {
+		s.wg.Wait()
+		s.mu.Lock()
+		s.drainDuration = time.Since(s.drainStart)
+		s.mu.Unlock()
+		close(s.drained)
+	}()
+	if s.Logger != nil {
+		go s.reportDrain(drainLogInterval, func(remaining int) {
+			s.logf("manners: waiting for %d connections to drain", remaining)
+		})
+	}
+	if s.DrainProgress != nil {
+		interval := s.DrainProgressInterval
+		if interval <= 0 {
+			interval = defaultDrainProgressInterval
+		}
+		go s.reportDrain(interval, s.DrainProgress)
+	}
+	s.mu.Lock()
+	eventsRead := s.eventsRead
+	s.mu.Unlock()
+	if eventsRead {
+		interval := s.DrainProgressInterval
+		if interval <= 0 {
+			interval = defaultDrainProgressInterval
+		}
+		go s.reportDrain(interval, func(remaining int) {
+			s.emit(EventProgressTick, remaining)
+		})
+	}
+	if drained, _ := s.awaitDrain(s.ShutdownTimeout); drained {
+		s.logf("manners: all connections drained")
+	}
+	if s.KeepIdleOnShutdown {
+		// Runs the functions registered with InnerServer.RegisterOnShutdown
+		// now that there is no idle connection left for it to close.
+		s.closeIdle()
+	}
+	s.drainDrainables()
+	s.emit(EventCompleted, s.DrainedCount())
+	if s.OnShutdownComplete != nil {
+		s.OnShutdownComplete()
+	}
+}
+
+// Passes the number of remaining connections to report every interval
+// until the drain is over.
+func (s *GracefulServer) reportDrain(interval time.Duration, report func(remaining int)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.drained:
+			return
+		case <-s.forced:
+			return
+		case <-ticker.C:
+			// A select picks at random among ready cases, so check
+			// again that the drain isn't over.
+			select {
+			case <-s.drained:
+				return
+			case <-s.forced:
+				return
+			default:
+			}
+			report(s.ConnectionCount())
+		}
+	}
+}
+
+func (s *GracefulServer) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// Reports whether Serve has been called since the server was created or
+// Reset, and so whether the server will drain once closed.
+func (s *GracefulServer) hasServed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serving
+}
+
+// Waits up to d for the server to drain, and closes the connections left
+// forcibly if it hasn't. Returns whether it drained without that happening
+// and, if not, the number of connections closed because a timeout elapsed.
+func (s *GracefulServer) awaitDrain(d time.Duration) (bool, int) {
+	if !s.hasServed() {
+		// Nothing will ever close drained.
+		return true, 0
+	}
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-s.drained:
+		// The forced connections are released after forced is closed.
+		select {
+		case <-s.forced:
+		default:
+			return true, 0
+		}
+	case <-s.forced:
+	case <-timeout:
+		s.forceCloseAtTimeout()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return false, s.timedOut
+}
+
+// Returns the number of requests being handled, counting every HTTP/2
+// stream separately. Requests turned away by RejectDuringShutdown are not
+// counted.
+func (s *GracefulServer) ActiveRequestCount() int {
+	return int(atomic.LoadInt64(&s.activeRequests))
+}
+
+// Closes and releases the new and idle connections if the server is
+// shutting down with WaitForRequestsNotConnections and no request is in
+// flight.
+func (s *GracefulServer) closeUnusedConns() {
+	if !s.WaitForRequestsNotConnections {
+		return
+	}
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if !closing {
+		return
+	}
+	s.closeGracefully(s.takeConns(func(tc *trackedConn) bool {
+		return tc.state == http.StateNew || tc.state == http.StateIdle && !isHTTP2(tc.conn)
+	}))
+}
+
+// Returns how long the server took to drain, from the moment its listeners
+// were closed until every connection and routine it waited for was gone,
+// including connections closed forcibly. Zero until the drain is complete.
+func (s *GracefulServer) DrainDuration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drainDuration
+}
+
+// Returns the number of connections accepted since the server was created,
+// including those accepted before a Reset.
+func (s *GracefulServer) AcceptedCount() int {
+	return int(atomic.LoadUint64(&s.acceptedCount))
+}
+
+// Returns the number of connections that have finished since Close was
+// called, not counting those closed forcibly.
+func (s *GracefulServer) DrainedCount() int {
+	return int(atomic.LoadUint64(&s.drainedCount))
+}
+
+// Returns the number of connections that have been closed forcibly because
+// the ShutdownTimeout or a DrainPolicy limit elapsed.
+func (s *GracefulServer) ForceClosedCount() int {
+	return int(atomic.LoadUint64(&s.forcedCount))
+}
+
+// Returns the number of connections counted by ForceClosedCount that were
+// in the middle of a request, or hijacked and tracked because of
+// TrackHijacked: those whose clients were cut off.
+func (s *GracefulServer) ForceClosedActive() int {
+	return int(atomic.LoadUint64(&s.forcedActiveCount))
+}
+
+// Returns the number of connections counted by ForceClosedCount that were
+// idle between requests, or new and yet to send one, so that no request
+// was lost.
+func (s *GracefulServer) ForceClosedIdle() int {
+	return int(atomic.LoadUint64(&s.forcedIdleCount))
+}
+
+// Closes the connections still open once the ShutdownTimeout has elapsed,
+// spread over StaggerForceClose.
+func (s *GracefulServer) forceCloseAtTimeout() {
+	if s.StaggerForceClose <= 0 {
+		s.forceClose()
+		return
+	}
+	s.mu.Lock()
+	var all []*trackedConn
+	for _, tc := range s.conns {
+		all = append(all, tc)
+	}
+	for _, tc := range s.hijacked {
+		all = append(all, tc)
+	}
+	s.mu.Unlock()
+	if len(all) == 0 {
+		s.forceClose()
+		return
+	}
+	s.sortForceCloseOrder(all)
+	s.logf("manners: shutdown timeout elapsed, closing %d connections over %v", len(all), s.StaggerForceClose)
+
+	batches := staggerBatches
+	if len(all) < batches {
+		batches = len(all)
+	}
+	slot := s.StaggerForceClose / time.Duration(batches)
+	start := time.Now()
+	pending := make(map[*trackedConn]bool, len(all))
+	for _, tc := range all {
+		pending[tc] = true
+	}
+	released := 0
+	for i := 0; i < batches; i++ {
+		if i > 0 {
+			s.mu.Lock()
+			left := s.countConns(func(tc *trackedConn) bool { return pending[tc] })
+			s.mu.Unlock()
+			if left == 0 {
+				break
+			}
+			at := time.Duration(i)*slot + time.Duration(rand.Int63n(int64(slot)+1))
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		batch := all[i*len(all)/batches : (i+1)*len(all)/batches]
+		in := make(map[*trackedConn]bool, len(batch))
+		for _, tc := range batch {
+			in[tc] = true
+			delete(pending, tc)
+		}
+		conns := s.takeConns(func(tc *trackedConn) bool { return in[tc] })
+		s.mu.Lock()
+		s.timedOut += len(conns)
+		s.mu.Unlock()
+		s.closeTaken(conns)
+		released += len(conns)
+	}
+	s.forceOnce.Do(func() { close(s.forced) })
+	s.releaseTaken(released)
+}
+
+// Closes every connection that is still open. Handlers running on those
+// connections are not interrupted, but their clients are cut off. The
+// connections are released right away rather than when the inner server
+// reports them closed, which it only does once their handlers return, so
+// that a wedged handler can't keep the WaitGroup, and the goroutine
+// waiting on it, from ever finishing.
+func (s *GracefulServer) forceClose() {
+	conns := s.takeConns(func(*trackedConn) bool { return true })
+	s.mu.Lock()
+	s.timedOut += len(conns)
+	s.mu.Unlock()
+	s.logf("manners: shutdown timeout elapsed, closing %d connections", len(conns))
+	s.closeTaken(conns)
+	s.forceOnce.Do(func() { close(s.forced) })
+	// Only now, so that drained can't be closed before forced is.
+	s.releaseTaken(len(conns))
+}
+
+// Stops tracking the connections that match and returns them in
+// ForceCloseOrder, leaving them to be closed by closeTaken and released by
+// releaseTaken.
+func (s *GracefulServer) takeConns(match func(*trackedConn) bool) []*trackedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var taken []*trackedConn
+	for conn, tc := range s.conns {
+		if match(tc) {
+			taken = append(taken, tc)
+			delete(s.conns, conn)
+		}
+	}
+	for gc, tc := range s.hijacked {
+		if match(tc) {
+			taken = append(taken, tc)
+			delete(s.hijacked, gc)
+		}
+	}
+	for _, tc := range taken {
+		s.uncountIP(tc)
+		// The inner server only cancels it once the handlers have
+		// returned, which may take a while.
+		if tc.cancel != nil {
+			tc.cancel()
+		}
+	}
+	s.sortForceCloseOrder(taken)
+	return taken
+}
+
+// Sorts connections in ForceCloseOrder.
+func (s *GracefulServer) sortForceCloseOrder(conns []*trackedConn) {
+	switch s.ForceCloseOrder {
+	case ForceCloseOldestFirst:
+		sort.Slice(conns, func(i, j int) bool { return conns[i].created.Before(conns[j].created) })
+	case ForceCloseNewestFirst:
+		sort.Slice(conns, func(i, j int) bool { return conns[i].created.After(conns[j].created) })
+	}
+}
+
+// Closes connections forcibly, counting them and calling OnForceClose.
+func (s *GracefulServer) closeTaken(taken []*trackedConn) {
+	atomic.AddUint64(&s.forcedCount, uint64(len(taken)))
+	conns := make([]net.Conn, len(taken))
+	for i, tc := range taken {
+		conns[i] = tc.conn
+		switch tc.state {
+		case http.StateActive, http.StateHijacked:
+			atomic.AddUint64(&s.forcedActiveCount, 1)
+		default:
+			atomic.AddUint64(&s.forcedIdleCount, 1)
+		}
+	}
+	if len(conns) > 0 {
+		s.emit(EventConnForceClosed, len(conns))
+	}
+	if s.ShutdownConnWriter != nil && len(conns) > 0 {
+		s.sayGoodbye(conns)
+	}
+	for _, conn := range conns {
+		if s.OnForceClose != nil {
+			s.OnForceClose(conn)
+		}
+		if s.ForceCloseWithReset {
+			if tc := unwrapTCPConn(conn); tc != nil {
+				tc.SetLinger(0)
+			}
+		}
+		if err := conn.Close(); err != nil {
+			s.logf("manners: error closing connection from %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// Calls ShutdownConnWriter with each of conns, waiting for the calls for no
+// longer than ShutdownConnWriteTimeout.
+func (s *GracefulServer) sayGoodbye(conns []net.Conn) {
+	timeout := s.ShutdownConnWriteTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownConnWriteTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		conn.SetWriteDeadline(deadline)
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			if err := s.ShutdownConnWriter(conn); err != nil {
+				s.logf("manners: error writing farewell to connection from %v: %v", conn.RemoteAddr(), err)
+			}
+		}(conn)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		s.logf("manners: ShutdownConnWriter took longer than %v; closing the connections anyway", timeout)
+	}
+}
+
+// Releases n connections returned by takeConns from the WaitGroup.
+func (s *GracefulServer) releaseTaken(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.FinishRoutine()
+	}
+	s.connClosed.Broadcast()
 }
@@ -1,8 +1,23 @@
 package manners
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // Tests that the server allows in-flight requests to complete before shutting
@@ -11,22 +26,22 @@ func TestGracefulness(t *testing.T) {
 	ready := make(chan bool)
 	done := make(chan bool)
 
-	exited := false
+	exited := make(chan bool, 1)
 
 	handler := newBlockingHandler(ready, done)
 	server := NewServer()
 
 	go func() {
 		err := server.ListenAndServe(":7000", handler)
-		if err != nil {
+		if err != ErrServerClosed {
 			t.Error(err)
 		}
 
-		exited = true
+		exited <- true
 	}()
 
 	go func() {
-		_, err := http.Get("http://localhost:7000")
+		_, err := getWhenListening("http://localhost:7000")
 		if err != nil {
 			t.Error(err)
 		}
@@ -38,9 +53,10 @@ func TestGracefulness(t *testing.T) {
 	server.Shutdown <- true
 	<-done
 
-	if exited {
+	select {
+	case <-exited:
 		t.Fatal("The request did not complete before server exited")
-	} else {
+	default:
 		// The handler is being allowed to run to completion; test passes.
 	}
 }
@@ -54,7 +70,7 @@ func TestShutdown(t *testing.T) {
 
 	go func() {
 		err := server.ListenAndServe(":7100", handler)
-		if err != nil {
+		if err != ErrServerClosed {
 			t.Error(err)
 		}
 		exited <- true
@@ -69,3 +85,3290 @@ func TestShutdown(t *testing.T) {
 		t.Fatal("Did not receive an error when trying to connect to server.")
 	}
 }
+
+// Tests that a wedged request cannot keep the server from shutting down once
+// the timeout elapses, and that the late StateClosed of the forcibly closed
+// connection does not upset the accounting.
+func TestBlockingCloseWithTimeout(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	clientErr := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + addr)
+		clientErr <- err
+	}()
+	<-ready
+
+	if server.BlockingCloseWithTimeout(50 * time.Millisecond) {
+		t.Fatal("Expected the drain to time out")
+	}
+	if err := <-clientErr; err == nil {
+		t.Fatal("Expected the client connection to be closed")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+
+	close(release)
+	server.wg.Wait()
+}
+
+// Tests that the ShutdownTimeout bounds how long Serve waits on shutdown,
+// and that the connections closed forcibly are reported.
+func TestShutdownTimeout(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := NewServer()
+	server.ShutdownTimeout = 50 * time.Millisecond
+	var forced []net.Conn
+	server.OnForceClose = func(conn net.Conn) { forced = append(forced, conn) }
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+
+	server.Shutdown <- true
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the shutdown timeout")
+	}
+	if len(forced) != 1 {
+		t.Fatalf("Expected OnForceClose to be called once, got %d", len(forced))
+	}
+	if n := server.ForceClosedCount(); n != 1 {
+		t.Fatalf("Expected 1 connection closed forcibly, got %d", n)
+	}
+}
+
+// Tests that BlockingCloseWithTimeout reports a clean drain.
+func TestBlockingCloseWithTimeoutDrained(t *testing.T) {
+	server := NewServer()
+	_, exited := startServer(t, server, newTestHandler())
+
+	if !server.BlockingCloseWithTimeout(time.Second) {
+		t.Fatal("Expected the server to drain cleanly")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that BlockingCloseTimeout reports the connections it had to close.
+func TestBlockingCloseTimeout(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	for i := 0; i < 2; i++ {
+		go http.Get("http://" + addr)
+		<-ready
+	}
+	drained, remaining := server.BlockingCloseTimeout(50 * time.Millisecond)
+	if drained || remaining != 2 {
+		t.Fatalf("Expected 2 connections left when the timeout elapsed, got %v, %d", drained, remaining)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+
+	idle := NewServer()
+	_, exited = startServer(t, idle, newTestHandler())
+	if drained, remaining := idle.BlockingCloseTimeout(time.Second); !drained || remaining != 0 {
+		t.Fatalf("Expected a clean drain, got %v, %d", drained, remaining)
+	}
+	<-exited
+}
+
+// Tests that ShutdownContext returns once the server has drained, and with
+// the context's error if the context expires first.
+func TestShutdownContext(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	server.forceClose()
+	if err := server.ShutdownContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ConnectionCount tracks open connections.
+func TestConnectionCount(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+	go http.Get("http://" + addr)
+	<-ready
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 connection, got %d", n)
+	}
+
+	close(release)
+	server.BlockingCloseWithTimeout(10 * time.Millisecond)
+	<-exited
+	server.wg.Wait()
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+}
+
+// Tests that PeakConnections keeps the most connections open at once until
+// ResetPeakConnections.
+func TestPeakConnections(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	go http.Get("http://" + addr + "/wedged")
+	<-ready
+	waitFor(t, func() bool { return server.ConnectionCount() == 2 })
+	idle.Close()
+	waitFor(t, func() bool { return server.ConnectionCount() == 1 })
+	if n := server.PeakConnections(); n != 2 {
+		t.Fatalf("Expected a peak of 2 connections, got %d", n)
+	}
+	if n := server.ResetPeakConnections(); n != 2 {
+		t.Fatalf("Expected ResetPeakConnections to return 2, got %d", n)
+	}
+	if n := server.PeakConnections(); n != 1 {
+		t.Fatalf("Expected the peak to start over from 1 connection, got %d", n)
+	}
+
+	release <- true
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that StateChanged observes connection state transitions after the
+// server has accounted for them.
+func TestStateChanged(t *testing.T) {
+	server := NewServer()
+	states := make(chan http.ConnState, 10)
+	server.StateChanged = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew && server.ConnectionCount() != 1 {
+			t.Error("StateChanged was called before the connection was counted")
+		}
+		states <- state
+	}
+	addr, exited := startServer(t, server, newTestHandler())
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	for _, want := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateClosed} {
+		if got := <-states; got != want {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+	server.Shutdown <- true
+	<-exited
+}
+
+// Tests that idle keep-alive connections don't hold up the drain.
+func TestCloseIdleOnShutdown(t *testing.T) {
+	server := NewServer()
+	addr, exited := startServer(t, server, newTestHandler())
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !server.BlockingCloseWithTimeout(5 * time.Second) {
+		t.Fatal("The idle connection was not closed")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Done is closed only after the drain completes.
+func TestDone(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+	server.Close()
+
+	select {
+	case <-server.Done():
+		t.Fatal("Done was closed while a request was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-server.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("Done was not closed after the drain")
+		}
+	}
+	<-exited
+}
+
+// Tests that Serve returns the listener's error when it fails without having
+// been closed.
+func TestServeListenerError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(NewListener(l, server), newTestHandler())
+	}()
+
+	// Close the listener underneath the GracefulListener.
+	l.Close()
+	err = <-exited
+	if err == nil || err == ErrServerClosed {
+		t.Fatalf("Expected the listener's error, got %v", err)
+	}
+}
+
+// Tests that ListenAndServeTLS negotiates HTTP/2 and still drains gracefully.
+func TestServeTLSHTTP2(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), newWedgedHandler(ready, release), certFile, keyFile)
+	}()
+
+	proto := make(chan int, 1)
+	go func() {
+		resp, err := newTLSClient().Get("https://" + l.Addr().String())
+		if err != nil {
+			t.Error(err)
+			proto <- 0
+			return
+		}
+		resp.Body.Close()
+		proto <- resp.ProtoMajor
+	}()
+	<-ready
+
+	server.Close()
+	close(release)
+	if p := <-proto; p != 2 {
+		t.Fatalf("Expected HTTP/2, got HTTP/%d", p)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests serving on a Unix domain socket, replacing a stale socket file and
+// removing the socket on shutdown.
+func TestListenAndServeUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manners.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServeUnix(path, 0600, newTestHandler())
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client.Get("http://unix/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected mode 0600, got %v", fi.Mode().Perm())
+	}
+	if err := server.ListenAndServeUnix(path, 0600, newTestHandler()); err == nil {
+		t.Fatal("Expected an error serving a socket that is in use")
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("The socket was not removed on shutdown")
+	}
+}
+
+// Tests that MaxConnections holds back new connections until an open one
+// closes, and that a listener waiting for capacity still shuts down.
+func TestMaxConnections(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.MaxConnections = 1
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	go client.Get("http://" + addr)
+	<-ready
+	go client.Get("http://" + addr)
+	select {
+	case <-ready:
+		t.Fatal("A connection was served beyond MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- true
+	<-ready
+
+	go client.Get("http://" + addr)
+	server.Close()
+	release <- true
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not shut down while at MaxConnections")
+	}
+}
+
+// Tests that a listener reserves its slot under MaxConnections before it
+// accepts, so that another listener can't take the same slot before the
+// connection is tracked, that a slot given back can be taken again, and
+// that the connection takes the slot over once it is reported as StateNew.
+func TestMaxConnectionsReserves(t *testing.T) {
+	server := NewServer()
+	server.MaxConnections = 1
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(inner, server)
+	defer l.Close()
+
+	reserved, ok := server.waitForCapacity(l)
+	if !reserved || !ok {
+		t.Fatalf("Expected a slot to be reserved, got %v %v", reserved, ok)
+	}
+	waited := make(chan bool, 1)
+	go func() {
+		reserved, _ := server.waitForCapacity(l)
+		waited <- reserved
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Expected the second listener to wait for the reserved slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.releaseSlot(true)
+	if reserved := <-waited; !reserved {
+		t.Fatal("Expected the released slot to be reserved again")
+	}
+
+	conn := &benchConn{}
+	server.holdSlot(conn, true)
+	server.updateConnState(conn, http.StateNew)
+	server.mu.Lock()
+	if server.reservedConns != 0 || len(server.heldSlots) != 0 {
+		t.Errorf("Expected the connection to take its slot over, got %d reserved", server.reservedConns)
+	}
+	server.mu.Unlock()
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 connection, got %d", n)
+	}
+	server.updateConnState(conn, http.StateClosed)
+	if reserved, ok := server.waitForCapacity(l); !reserved || !ok {
+		t.Fatal("Expected the slot to be free once the connection closed")
+	}
+}
+
+func TestSetMaxConnections(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.MaxConnections = 1
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	go client.Get("http://" + addr)
+	<-ready
+	go client.Get("http://" + addr)
+	select {
+	case <-ready:
+		t.Fatal("A connection was served beyond MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.SetMaxConnections(2)
+	<-ready
+
+	// Lowering the limit closes nothing, but holds new connections back.
+	server.SetMaxConnections(1)
+	go client.Get("http://" + addr)
+	select {
+	case <-ready:
+		t.Fatal("A connection was served beyond the lowered MaxConnections")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := server.ConnectionCount(); n != 2 {
+		t.Fatalf("Expected both connections to stay open, got %d", n)
+	}
+	release <- true
+	release <- true
+	<-ready
+	release <- true
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Drain stops new connections but keeps serving open ones.
+func TestDrain(t *testing.T) {
+	server := NewServer()
+	addr, exited := startServer(t, server, newTestHandler())
+	client := &http.Client{Transport: &http.Transport{}}
+
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if server.IsDraining() {
+		t.Fatal("The server reports draining before Drain was called")
+	}
+
+	server.Drain()
+	if !server.IsDraining() {
+		t.Fatal("The server doesn't report draining after Drain was called")
+	}
+	// The idle connection is reused and still served.
+	resp, err = client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("A new connection was accepted after Drain")
+	}
+	select {
+	case <-exited:
+		t.Fatal("Serve returned while a connection was still open")
+	default:
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that the shutdown is logged.
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	server := NewServer()
+	server.Logger = logger
+	_, exited := startServer(t, server, newTestHandler())
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+
+	messages := strings.Join(logger.Messages(), "\n")
+	for _, want := range []string{"shutting down", "no longer accepting", "drained"} {
+		if !strings.Contains(messages, want) {
+			t.Errorf("Expected a message containing %q, got:\n%s", want, messages)
+		}
+	}
+}
+
+// Tests that a server with several listeners serves on all of them and
+// drains the connections from all of them on shutdown.
+func TestAddListener(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(NewListener(extra, server)); err != nil {
+		t.Fatal(err)
+	}
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+	go http.Get("http://" + extra.Addr().String())
+	<-ready
+
+	server.Close()
+	if err := server.AddListener(NewListener(extra, server)); err == nil {
+		t.Fatal("Expected an error adding a listener after Close")
+	}
+	if _, err := net.Dial("tcp", extra.Addr().String()); err == nil {
+		t.Fatal("The added listener was not closed")
+	}
+	release <- true
+	select {
+	case <-exited:
+		t.Fatal("Serve returned before the connections from every listener drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a listener can't be served twice by the same server.
+func TestListenerAlreadyServing(t *testing.T) {
+	server := NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gl := NewListener(l, server)
+	if err := server.AddListener(gl); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(gl); err != ErrListenerAlreadyServing {
+		t.Fatalf("Expected ErrListenerAlreadyServing adding a listener twice, got %v", err)
+	}
+	if err := server.Serve(gl, nil); err != ErrListenerAlreadyServing {
+		t.Fatalf("Expected ErrListenerAlreadyServing serving an added listener, got %v", err)
+	}
+	l.Close()
+
+	server = NewServer()
+	addr, exited := startServer(t, server, nil)
+	<-server.Listening()
+	served := server.Listener()
+	if err := server.Serve(served, nil); err != ErrListenerAlreadyServing {
+		t.Fatalf("Expected ErrListenerAlreadyServing serving a listener twice, got %v", err)
+	}
+	if err := server.AddListener(served); err != ErrListenerAlreadyServing {
+		t.Fatalf("Expected ErrListenerAlreadyServing adding a served listener, got %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&server.acceptedCount); n != 1 {
+		t.Fatalf("Expected the connection to be accepted once, got %d", n)
+	}
+}
+
+// Tests that a second Serve call serves its listener alongside the first
+// with the first call's handler, and that both calls return once the server
+// is closed.
+func TestServeTwice(t *testing.T) {
+	server := NewServer()
+	first := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "first") })
+	second := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "second") })
+	addr1, exited1 := startServer(t, server, first)
+	<-server.Listening()
+	addr2, exited2 := startServer(t, server, second)
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.listeners) == 2
+	})
+	server.mu.Lock()
+	loops := server.acceptLoops
+	server.mu.Unlock()
+	if loops != 2 {
+		t.Fatalf("Expected an accept loop for each of the 2 listeners, got %d", loops)
+	}
+
+	for _, addr := range []string{addr1, addr2} {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "first" {
+			t.Fatalf("Expected the first handler to serve %s, got %q", addr, body)
+		}
+	}
+
+	server.Close()
+	for _, exited := range []chan error{exited1, exited2} {
+		select {
+		case err := <-exited:
+			if err != ErrServerClosed {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("A Serve call didn't return after Close")
+		}
+	}
+}
+
+// Tests that a listener added once Serve has started is served, and that
+// removing it waits for its own connections only.
+func TestRemoveListener(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+	<-server.Listening()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := NewListener(l, server)
+	if err := server.AddListener(late); err != nil {
+		t.Fatal(err)
+	}
+	go http.Get("http://" + l.Addr().String() + "/wedged")
+	<-ready
+
+	removed := make(chan error, 1)
+	go func() { removed <- server.RemoveListener(late) }()
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+	select {
+	case err := <-removed:
+		t.Fatalf("RemoveListener returned before its connection was done: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Expected the other listener to keep serving: %v", err)
+	}
+	resp.Body.Close()
+
+	release <- true
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RemoveListener(late); err == nil {
+		t.Fatal("Expected an error removing a listener twice")
+	}
+	server.mu.Lock()
+	last := server.listeners[0]
+	server.mu.Unlock()
+	if err := server.RemoveListener(last); err == nil {
+		t.Fatal("Expected an error removing the last listener")
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that RemoveListener waits for a request in flight on the listener
+// when CountBytes wraps the connections it accepts.
+func TestRemoveListenerCountBytes(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.CountBytes = true
+	_, exited := startServer(t, server, newWedgedHandler(ready, release))
+	<-server.Listening()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := NewListener(l, server)
+	if err := server.AddListener(late); err != nil {
+		t.Fatal(err)
+	}
+	go http.Get("http://" + l.Addr().String())
+	<-ready
+
+	removed := make(chan error, 1)
+	go func() { removed <- server.RemoveListener(late) }()
+	select {
+	case err := <-removed:
+		t.Fatalf("RemoveListener returned before its connection was done: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	pending := len(server.pending)
+	server.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected no connection left pending, got %d", pending)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a listener passed to a second Serve call can be removed, leaving
+// the first listener serving.
+func TestRemoveListenerFromSecondServe(t *testing.T) {
+	server := NewServer()
+	addr, exited1 := startServer(t, server, newTestHandler())
+	<-server.Listening()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	late := NewListener(l, server)
+	exited2 := make(chan error, 1)
+	go func() { exited2 <- server.Serve(late, nil) }()
+	waitFor(t, func() bool { return getErr("http://"+l.Addr().String()) == nil })
+
+	if err := server.RemoveListener(late); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.acceptLoops == 1
+	})
+	if err := getErr("http://" + l.Addr().String()); err == nil {
+		t.Fatal("Expected the removed listener to be closed")
+	}
+	if err := getErr("http://" + addr); err != nil {
+		t.Fatalf("Expected the first listener to keep serving: %v", err)
+	}
+
+	server.Close()
+	for _, exited := range []chan error{exited1, exited2} {
+		select {
+		case err := <-exited:
+			if err != ErrServerClosed {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("A Serve call didn't return after Close")
+		}
+	}
+}
+
+// Tests that a connection closed by the inner server's IdleTimeout during a
+// drain is released from the drain.
+func TestIdleTimeoutDuringDrain(t *testing.T) {
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	server.InnerServer.IdleTimeout = 300 * time.Millisecond
+	addr, exited := startServer(t, server, newTestHandler())
+
+	client := &http.Client{Transport: &http.Transport{}}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+	start := time.Now()
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	server.Close()
+	select {
+	case err := <-exited:
+		t.Fatalf("Serve returned before IdleTimeout elapsed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected the idle connection to stay open until IdleTimeout, got %d connections", n)
+	}
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The idle connection was not released after IdleTimeout")
+	}
+	if elapsed := time.Since(start); elapsed < server.InnerServer.IdleTimeout {
+		t.Fatalf("Expected the drain to last until IdleTimeout, took %v", elapsed)
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+}
+
+// Tests that requests arriving during a shutdown are turned away, while the
+// one in flight when it began completes.
+func TestRejectDuringShutdown(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	server.RejectDuringShutdown = true
+	addr, exited := startServer(t, server, mux)
+	client := &http.Client{Transport: &http.Transport{}}
+
+	// Open a keep-alive connection for the request after the drain.
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/wedged")
+		if err != nil {
+			t.Error(err)
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-ready
+
+	server.Drain()
+	resp, err = client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !resp.Close {
+		t.Fatalf("Expected a 503 closing the connection, got %d (close %v)", resp.StatusCode, resp.Close)
+	}
+
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Fatalf("Expected the in-flight request to succeed, got %d", code)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests shutting down while several accept loops are busy accepting
+// connections: no connection may be counted after the drain has completed.
+func TestCloseDuringAccept(t *testing.T) {
+	server := NewServer()
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.AddListener(NewListener(l, server))
+		addrs = append(addrs, l.Addr().String())
+	}
+	addr, exited := startServer(t, server, newTestHandler())
+	addrs = append(addrs, addr)
+
+	stop := make(chan bool)
+	var clients sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		clients.Add(1)
+		go func(addr string) {
+			defer clients.Done()
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if resp, err := client.Get("http://" + addr); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}(addrs[i%len(addrs)])
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	<-server.Done()
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections after the drain, got %d", n)
+	}
+	close(stop)
+	clients.Wait()
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("A connection was counted after the drain: %d", n)
+	}
+}
+
+// Tests that the shutdown hooks fire once each, at the right moments.
+func TestShutdownHooks(t *testing.T) {
+	server := NewServer()
+	var initiated, completed int
+	var listening bool
+	addr, exited := startServer(t, server, newTestHandler())
+	server.OnShutdownInitiated = func() {
+		initiated++
+		conn, err := net.Dial("tcp", addr)
+		if listening = err == nil; listening {
+			conn.Close()
+		}
+	}
+	server.OnShutdownComplete = func() { completed++ }
+	// Wait until the server is serving.
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var closers sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			server.Close()
+		}()
+	}
+	closers.Wait()
+	if initiated != 1 {
+		t.Fatalf("Expected OnShutdownInitiated to be called once, got %d", initiated)
+	}
+	if !listening {
+		t.Fatal("The listener was closed before OnShutdownInitiated was called")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if completed != 1 {
+		t.Fatalf("Expected OnShutdownComplete to be called once, got %d", completed)
+	}
+}
+
+// Tests that hijacked connections hold up the drain when TrackHijacked is
+// set, until they are closed.
+func TestTrackHijacked(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	server := NewServer()
+	server.TrackHijacked = true
+	addr, exited := startServer(t, server, newHijackingHandler(conns))
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	hijacked := <-conns
+
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 connection, got %d", n)
+	}
+	if listed := server.HijackedConnections(); len(listed) != 1 || listed[0] != hijacked {
+		t.Fatalf("Expected the hijacked connection to be listed, got %v", listed)
+	}
+
+	server.Close()
+	select {
+	case <-exited:
+		t.Fatal("Serve returned while a hijacked connection was open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	hijacked.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+}
+
+// Tests that a tracked hijacked connection stops counting exactly once, however
+// often it is closed or marked closed.
+func TestTrackHijackedReleasedOnce(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	server := NewServer()
+	server.TrackHijacked = true
+	addr, exited := startServer(t, server, newHijackingHandler(conns))
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	hijacked := <-conns
+
+	hijacked.Close()
+	hijacked.Close()
+	server.MarkClosed(hijacked)
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that tracked hijacked connections are closed forcibly when the
+// shutdown timeout elapses.
+func TestTrackHijackedTimeout(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	server := NewServer()
+	server.TrackHijacked = true
+	server.ShutdownTimeout = 50 * time.Millisecond
+	addr, exited := startServer(t, server, newHijackingHandler(conns))
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	<-conns
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n, _ := client.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Expected the hijacked connection to be closed")
+	}
+}
+
+// Stands in for an accepted connection in the benchmarks below. Only its
+// identity matters.
+type benchConn struct {
+	net.Conn
+	id int
+}
+
+func (c *benchConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+// Tests that the connection accounting ignores state changes for
+// connections it isn't tracking, so StateClosed without a StateNew, or a
+// second StateClosed, cannot drive the WaitGroup negative.
+func TestUntrackedStateClosed(t *testing.T) {
+	server := NewServer()
+	stray := &benchConn{}
+	server.updateConnState(stray, http.StateClosed)
+	server.updateConnState(stray, http.StateHijacked)
+
+	conn := &benchConn{}
+	server.updateConnState(conn, http.StateNew)
+	server.updateConnState(conn, http.StateClosed)
+	server.updateConnState(conn, http.StateClosed)
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+
+	// The WaitGroup is back at zero, neither above nor below.
+	server.wg.Add(1)
+	server.wg.Done()
+	waited := make(chan bool)
+	go func() {
+		server.wg.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the WaitGroup to be at zero")
+	}
+}
+
+// Measures connection churn through the server's connection tracking. It
+// is an order of magnitude slower than BenchmarkConnTrackingWaitGroup: the
+// record of each connection costs an allocation, map updates under s.mu and
+// a timestamp per state change, which a bare WaitGroup doesn't have.
+// BenchmarkConnTrackingCountOnly measures the cheaper counting of CountOnly.
+func BenchmarkConnTracking(b *testing.B) {
+	server := NewServer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn := &benchConn{}
+			server.updateConnState(conn, http.StateNew)
+			server.updateConnState(conn, http.StateActive)
+			server.updateConnState(conn, http.StateIdle)
+			server.updateConnState(conn, http.StateClosed)
+		}
+	})
+}
+
+// Measures the same churn through the counting done under CountOnly.
+func BenchmarkConnTrackingCountOnly(b *testing.B) {
+	server := NewServer()
+	server.CountOnly = true
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn := &benchConn{}
+			server.countConnState(conn, http.StateNew)
+			server.countConnState(conn, http.StateActive)
+			server.countConnState(conn, http.StateIdle)
+			server.countConnState(conn, http.StateClosed)
+		}
+	})
+}
+
+// Measures the same churn counted with a bare WaitGroup, as manners did
+// before it kept a set of connections.
+func BenchmarkConnTrackingWaitGroup(b *testing.B) {
+	var wg sync.WaitGroup
+	connState := func(conn net.Conn, newState http.ConnState) {
+		switch newState {
+		case http.StateNew:
+			wg.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			wg.Done()
+		}
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn := &benchConn{}
+			connState(conn, http.StateNew)
+			connState(conn, http.StateActive)
+			connState(conn, http.StateIdle)
+			connState(conn, http.StateClosed)
+		}
+	})
+}
+
+// Tests that a response written during the drain tells the client to close
+// the connection, even when idle connections are left alone.
+func TestKeepAlivesDisabledOnClose(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		resp.Body.Close()
+		responses <- resp
+	}()
+	<-ready
+
+	server.Close()
+	release <- true
+	resp := <-responses
+	if resp == nil {
+		t.FailNow()
+	}
+	if !resp.Close {
+		t.Fatal("Expected the response to carry Connection: close")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Close leaves an idle keep-alive connection open when
+// KeepIdleOnShutdown is set, and that a request on it during the drain is
+// answered with Connection: close.
+func TestIdleConnSurvivesClose(t *testing.T) {
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	server.InnerServer.IdleTimeout = time.Hour
+	addr, exited := startServer(t, server, newTestHandler())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	get := func() *http.Response {
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := get(); resp.Close {
+		t.Fatal("Expected the response before Close to keep the connection alive")
+	}
+	waitFor(t, func() bool { return server.ConnectionStates()[http.StateIdle] == 1 })
+
+	server.Close()
+	select {
+	case err := <-exited:
+		t.Fatalf("Serve returned with an idle connection open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected the idle connection to stay open, got %d connections", n)
+	}
+
+	if resp := get(); !resp.Close {
+		t.Fatal("Expected the response during the drain to carry Connection: close")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests the connection statistics that the metrics are built from.
+func TestConnStats(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	done := make(chan bool)
+	go func() {
+		if resp, err := http.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+		done <- true
+	}()
+	<-ready
+
+	if states := server.ConnectionStates(); states[http.StateActive] != 1 || states[http.StateIdle] != 0 {
+		t.Fatalf("Expected 1 active connection, got %v", states)
+	}
+	server.Close()
+	release <- true
+	<-done
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&server.acceptedCount); n != 1 {
+		t.Fatalf("Expected 1 accepted connection, got %d", n)
+	}
+	if n := atomic.LoadUint64(&server.drainedCount); n != 1 {
+		t.Fatalf("Expected 1 drained connection, got %d", n)
+	}
+}
+
+// Tests that a server listening on port 0 reports the port it was given, and
+// the listener it created.
+func TestAddr(t *testing.T) {
+	server := NewServer()
+	if addr := server.Addr(); addr != nil {
+		t.Fatalf("Expected no address before Serve, got %v", addr)
+	}
+	if l := server.Listener(); l != nil {
+		t.Fatal("Expected no listener before Serve")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServe("127.0.0.1:0", newTestHandler())
+	}()
+	<-server.Listening()
+
+	addr := server.Addr()
+	if addr == nil || strings.HasSuffix(addr.String(), ":0") {
+		t.Fatalf("Expected the bound address, got %v", addr)
+	}
+	if l := server.Listener(); l == nil || l.Addr() != addr {
+		t.Fatal("Expected the listener ListenAndServe created")
+	}
+	resp, err := http.Get("http://" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that DrainProgress reports the remaining connections during a drain
+// and stops once it is over.
+func TestDrainProgress(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	progress := make(chan int, 100)
+	server := NewServer()
+	server.DrainProgress = func(remaining int) { progress <- remaining }
+	server.DrainProgressInterval = 10 * time.Millisecond
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go func() {
+		if resp, err := http.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-ready
+	server.Close()
+
+	if remaining := <-progress; remaining != 1 {
+		t.Fatalf("Expected 1 remaining connection, got %d", remaining)
+	}
+	release <- true
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	// Allow for a tick that raced with the end of the drain.
+	time.Sleep(50 * time.Millisecond)
+	n := len(progress)
+	time.Sleep(50 * time.Millisecond)
+	if len(progress) != n {
+		t.Fatal("DrainProgress was still called after the drain")
+	}
+}
+
+// Tests that Close and BlockingClose may be called from many goroutines at
+// once, and that every blocking caller returns once the server has drained.
+func TestConcurrentClose(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go func() {
+		if resp, err := http.Get("http://" + addr); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-ready
+
+	var closers sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			server.Close()
+		}()
+	}
+	blocked := make(chan bool, 3)
+	for i := 0; i < cap(blocked); i++ {
+		go func() {
+			blocked <- server.BlockingClose()
+		}()
+	}
+	closers.Wait()
+
+	select {
+	case <-blocked:
+		t.Fatal("BlockingClose returned before the server drained")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	for i := 0; i < cap(blocked); i++ {
+		if !<-blocked {
+			t.Fatal("Expected BlockingClose to report a clean drain")
+		}
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if !server.BlockingClose() {
+		t.Fatal("Expected BlockingClose after the drain to return true")
+	}
+}
+
+// Tests that the server keeps accepting connections for MinDrainDuration
+// after Close, even with none open.
+func TestMinDrainDuration(t *testing.T) {
+	server := NewServer()
+	server.MinDrainDuration = 100 * time.Millisecond
+	addr, exited := startServer(t, server, newTestHandler())
+	<-server.Listening()
+
+	start := time.Now()
+	server.Close()
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Expected a connection during the drain period to be served: %v", err)
+	}
+	resp.Body.Close()
+
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < server.MinDrainDuration {
+		t.Fatalf("Serve returned after %v, before MinDrainDuration", elapsed)
+	}
+}
+
+// Tests that WaitForZeroConnections waits for the open connections without
+// closing the server.
+func TestWaitForZeroConnections(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	go func() {
+		if resp, err := client.Get("http://" + addr + "/wedged"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-ready
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.WaitForZeroConnections(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the wait to time out, got %v", err)
+	}
+	release <- true
+	if err := server.WaitForZeroConnections(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Expected the server to keep accepting connections: %v", err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that NewServer applies its options over the defaults.
+func TestNewServerOptions(t *testing.T) {
+	logger := &testLogger{}
+	server := NewServer(WithShutdownTimeout(time.Second), WithLogger(logger), WithMaxConnections(10))
+	if server.ShutdownTimeout != time.Second {
+		t.Errorf("Expected a ShutdownTimeout of 1s, got %v", server.ShutdownTimeout)
+	}
+	if server.Logger != logger {
+		t.Error("Expected the Logger to be set")
+	}
+	if server.MaxConnections != 10 {
+		t.Errorf("Expected MaxConnections to be 10, got %d", server.MaxConnections)
+	}
+	if server.KeepAlivePeriod != 3*time.Minute {
+		t.Error("Expected the defaults to be kept")
+	}
+}
+
+// Tests that a zero GracefulServer serves, tracks its connections and
+// drains them on Close like one from NewServer.
+func TestZeroServer(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := &GracefulServer{}
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+	<-server.Listening()
+
+	go http.Get("http://" + addr)
+	<-ready
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 tracked connection, got %d", n)
+	}
+	server.Close()
+	select {
+	case err := <-exited:
+		t.Fatalf("Serve returned before the request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if err := server.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that functions registered with RegisterOnShutdown run once when the
+// server is closed, as do those registered on the inner server.
+func TestRegisterOnShutdown(t *testing.T) {
+	server := NewServer()
+	called := make(chan string, 4)
+	server.RegisterOnShutdown(func() { called <- "server" })
+	server.InnerServer.RegisterOnShutdown(func() { called <- "inner" })
+	_, exited := startServer(t, server, newTestHandler())
+	<-server.Listening()
+
+	server.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-called:
+			seen[name] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Expected both functions to run, got %v", seen)
+		}
+	}
+	if !seen["server"] || !seen["inner"] {
+		t.Fatalf("Expected both functions to run, got %v", seen)
+	}
+	select {
+	case name := <-called:
+		t.Fatalf("Expected each function to run once, %s ran again", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Tests that the functions registered on InnerServer still run when idle
+// connections are left open, once the drain is over.
+func TestInnerServerRegisterOnShutdown(t *testing.T) {
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	called := make(chan bool, 1)
+	server.InnerServer.RegisterOnShutdown(func() { called <- true })
+	addr, exited := startServer(t, server, newTestHandler())
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	server.Close()
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected the idle connection to stay open, got %d connections", n)
+	}
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the function registered on InnerServer to run")
+	}
+}
+
+// Tests that ConnectionStats describes the open connections.
+func TestConnectionStats(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	server.CountBytes = true
+	addr, exited := startServer(t, server, mux)
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// Two requests on the connection; the second one blocks.
+	first := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	second := "GET /wedged HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	client.Write([]byte(first))
+	client.Write([]byte(second))
+	<-ready
+
+	stats := server.ConnectionStats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected 1 connection, got %v", stats)
+	}
+	info := stats[0]
+	if info.RemoteAddr == nil || info.RemoteAddr.String() != client.LocalAddr().String() {
+		t.Errorf("Expected the remote address %v, got %v", client.LocalAddr(), info.RemoteAddr)
+	}
+	if info.State != http.StateActive {
+		t.Errorf("Expected the connection to be active, got %v", info.State)
+	}
+	if info.Requests != 1 {
+		t.Errorf("Expected 1 request served, got %d", info.Requests)
+	}
+	if info.Age <= 0 {
+		t.Errorf("Expected a positive age, got %v", info.Age)
+	}
+	if n := len(first) + len(second); info.BytesRead != uint64(n) {
+		t.Errorf("Expected %d bytes read, got %d", n, info.BytesRead)
+	}
+	if info.BytesWritten == 0 {
+		t.Error("Expected the first response to be counted as written")
+	}
+	if d := time.Since(info.LastActivity); d < 0 || d > info.Age+time.Second {
+		t.Errorf("Expected recent activity on the connection, got %v", info.LastActivity)
+	}
+
+	release <- true
+	server.Close()
+	client.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A response handler that writes its name.
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Write([]byte(h))
+}
+
+// Tests that SetHandler switches new requests to the new handler while
+// requests are being served concurrently.
+func TestSetHandler(t *testing.T) {
+	server := NewServer()
+	addr, exited := startServer(t, server, namedHandler("old"))
+	<-server.Listening()
+
+	get := func() string {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if body := get(); body != "old" {
+		t.Fatalf("Expected the old handler, got %q", body)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	server.SetHandler(namedHandler("new"))
+	wg.Wait()
+	if body := get(); body != "new" {
+		t.Fatalf("Expected the new handler, got %q", body)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// A listener whose Close fails.
+type unclosableListener struct {
+	net.Listener
+	err error
+}
+
+func (l *unclosableListener) Close() error {
+	l.Listener.Close()
+	return l.err
+}
+
+// Tests that Close returns the errors from closing every listener.
+func TestCloseListenerErrors(t *testing.T) {
+	server := NewServer()
+	var errs []error
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs = append(errs, fmt.Errorf("listener %d", i))
+		listeners = append(listeners, NewListener(&unclosableListener{l, errs[i]}, server))
+	}
+	if err := server.AddListener(listeners[1]); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Serve(listeners[0], newTestHandler())
+	}()
+	<-server.Listening()
+
+	err := server.Close()
+	for _, want := range errs {
+		if !errors.Is(err, want) {
+			t.Errorf("Expected Close to return %v, got %v", want, err)
+		}
+	}
+	if err := server.Close(); err != nil {
+		t.Errorf("Expected a second Close to return nil, got %v", err)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that the readiness handler fails once the server is closed, even
+// while it is still serving during MinDrainDuration.
+func TestReadinessHandler(t *testing.T) {
+	server := NewServer()
+	server.MinDrainDuration = time.Minute
+	ready := server.ReadinessHandler()
+
+	probe := func() int {
+		w := httptest.NewRecorder()
+		ready.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+	if code := probe(); code != http.StatusOK {
+		t.Fatalf("Expected 200 before Close, got %d", code)
+	}
+	server.Close()
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 after Close, got %d", code)
+	}
+
+	drained := NewServer()
+	ready = drained.ReadinessHandler()
+	drained.Drain()
+	if code := probe(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 after Drain, got %d", code)
+	}
+}
+
+// Tests that CloseOnChannel closes the server when the channel is closed.
+func TestCloseOnChannel(t *testing.T) {
+	server := NewServer()
+	_, exited := startServer(t, server, newTestHandler())
+	stop := make(chan struct{})
+	server.CloseOnChannel(stop)
+	<-server.Listening()
+
+	close(stop)
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Closing the channel did not close the server")
+	}
+}
+
+// Tests that a tracked hijacked connection can be released with MarkClosed
+// without closing it.
+func TestMarkClosed(t *testing.T) {
+	conns := make(chan net.Conn, 1)
+	server := NewServer()
+	server.TrackHijacked = true
+	addr, exited := startServer(t, server, newHijackingHandler(conns))
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	hijacked := <-conns
+	defer hijacked.Close()
+
+	if !server.IsTracked(hijacked) {
+		t.Fatal("Expected the hijacked connection to be tracked")
+	}
+	server.MarkClosed(hijacked)
+	server.MarkClosed(hijacked)
+	if server.IsTracked(hijacked) {
+		t.Fatal("Expected the connection to be released")
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected 0 connections, got %d", n)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	// The connection was left open.
+	if _, err := hijacked.Write([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that DrainMatching closes the matching connections, waiting for a
+// busy one to finish its request, and leaves the others alone.
+func TestDrainMatching(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+
+	// Sends a request on conn and reads the response.
+	request := func(conn net.Conn, r *bufio.Reader, host, path string) *http.Response {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	idleA, idleAr := dial()
+	defer idleA.Close()
+	request(idleA, idleAr, "a.example", "/")
+	idleB, idleBr := dial()
+	defer idleB.Close()
+	request(idleB, idleBr, "b.example", "/")
+	busyA, busyAr := dial()
+	defer busyA.Close()
+	fmt.Fprintf(busyA, "GET /wedged HTTP/1.1\r\nHost: a.example\r\n\r\n")
+	<-ready
+
+	matched := server.DrainMatching(func(info ConnInfo) bool {
+		return info.Host == "a.example"
+	})
+	if matched != 2 {
+		t.Fatalf("Expected 2 connections to match, got %d", matched)
+	}
+	if _, err := idleAr.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the idle matching connection to be closed, got %v", err)
+	}
+
+	release <- true
+	resp, err := http.ReadResponse(busyAr, nil)
+	if err != nil {
+		t.Fatalf("Expected the busy connection to finish its request: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := busyAr.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the busy matching connection to be closed, got %v", err)
+	}
+
+	if resp := request(idleB, idleBr, "b.example", "/"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the other connection to keep serving, got %d", resp.StatusCode)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ListenAndServe creates its listener with ListenerFactory.
+func TestListenerFactory(t *testing.T) {
+	server := NewServer()
+	requested := make(chan string, 1)
+	server.ListenerFactory = func(addr string) (net.Listener, error) {
+		requested <- addr
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServe("example.com:80", newTestHandler())
+	}()
+	<-server.Listening()
+	if addr := <-requested; addr != "example.com:80" {
+		t.Fatalf("Expected the factory to be given example.com:80, got %s", addr)
+	}
+
+	resp, err := http.Get("http://" + server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a server that has drained can be served again after Reset, and
+// that Reset refuses a server that hasn't drained.
+func TestReset(t *testing.T) {
+	server := NewServer()
+	server.InnerServer.ReadTimeout = time.Minute
+	if err := server.Reset(); err == nil {
+		t.Fatal("Expected Reset to fail before the server drained")
+	}
+
+	for i := 0; i < 2; i++ {
+		addr, exited := startServer(t, server, newTestHandler())
+		<-server.Listening()
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatalf("Serving for the %d. time: %v", i+1, err)
+		}
+		resp.Body.Close()
+		if !server.BlockingClose() {
+			t.Fatal("Expected the server to drain cleanly")
+		}
+		if err := <-exited; err != ErrServerClosed {
+			t.Fatal(err)
+		}
+		if err := server.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if server.IsDraining() {
+			t.Fatal("Expected the server not to be draining after Reset")
+		}
+	}
+	if server.InnerServer.ReadTimeout != time.Minute {
+		t.Fatalf("Expected Reset to keep the ReadTimeout, got %v", server.InnerServer.ReadTimeout)
+	}
+}
+
+// Tests that ActiveDrainTimeout cuts off a client that doesn't read the
+// response it is being sent.
+func TestActiveDrainTimeout(t *testing.T) {
+	ready := make(chan bool, 1)
+	failed := make(chan error, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := make([]byte, 64<<10)
+		ready <- true
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				failed <- err
+				return
+			}
+		}
+	})
+	server := NewServer()
+	server.ActiveDrainTimeout = 100 * time.Millisecond
+	addr, exited := startServer(t, server, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	<-ready
+	server.Close()
+
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The write to the slow client was not cut off")
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the slow client was cut off")
+	}
+}
+
+// Tests that no goroutine is left waiting for the drain once the shutdown
+// timeout has closed a connection whose handler never returns.
+func TestShutdownTimeoutGoroutines(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	before := runtime.NumGoroutine()
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	<-ready
+	if server.BlockingCloseWithTimeout(50 * time.Millisecond) {
+		t.Fatal("Expected the connection to be closed forcibly")
+	}
+	<-exited
+	conn.Close()
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done was not closed after the connection was closed forcibly")
+	}
+
+	// Only the wedged handler may still be running.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected at most %d goroutines, got %d", before+1, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that a connection marked disposable is closed on shutdown rather
+// than waited for, while other connections are still waited for.
+func TestMarkDisposable(t *testing.T) {
+	ready := make(chan bool, 2)
+	release := make(chan bool)
+	done := make(chan bool, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		MarkDisposable(r)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		ready <- true
+		<-r.Context().Done()
+		done <- true
+	})
+	mux.Handle("/", newWedgedHandler(ready, release))
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+
+	go http.Get("http://" + addr + "/events")
+	go http.Get("http://" + addr + "/")
+	<-ready
+	<-ready
+	server.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The disposable connection was not closed")
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected only the wedged connection to be waited for, got %d", n)
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a connection whose request has a drain deadline is closed
+// forcibly once it passes, while other connections are still waited for.
+func TestSetDrainDeadline(t *testing.T) {
+	ready := make(chan bool, 2)
+	release := make(chan bool)
+	done := make(chan bool, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deadline", func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.Header.Get("X-Max-Duration"))
+		SetDrainDeadline(r, time.Now().Add(d))
+		ready <- true
+		<-r.Context().Done()
+		done <- true
+	})
+	mux.Handle("/", newWedgedHandler(ready, release))
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+
+	req, err := http.NewRequest("GET", "http://"+addr+"/deadline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Max-Duration", "200ms")
+	go http.DefaultClient.Do(req)
+	go http.Get("http://" + addr + "/")
+	<-ready
+	<-ready
+	start := time.Now()
+	server.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection was not closed at its drain deadline")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Expected the connection to be waited for until its deadline, closed after %v", d)
+	}
+	if n := server.ForceClosedCount(); n != 1 {
+		t.Fatalf("Expected 1 connection closed forcibly, got %d", n)
+	}
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected only the wedged connection to be waited for, got %d", n)
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that the DrainPolicy closes idle and active connections after their
+// own timeouts. Close closes idle HTTP/1 connections itself, so the idle one
+// is an HTTP/2 connection, which Close would send a GOAWAY unless
+// KeepIdleOnShutdown is set.
+func TestDrainPolicy(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	server.DrainPolicy = DrainPolicy{
+		IdleTimeout:   50 * time.Millisecond,
+		ActiveTimeout: 500 * time.Millisecond,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), mux, certFile, keyFile)
+	}()
+	url := "https://" + l.Addr().String()
+
+	resp, err := newTLSClient().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	go newTLSClient().Get(url + "/wedged")
+	<-ready
+	waitFor(t, func() bool { return server.ConnectionStates()[http.StateIdle] == 1 })
+	server.Close()
+
+	waitFor(t, func() bool { return server.ConnectionCount() == 1 })
+	if n := server.ForceClosedCount(); n != 1 {
+		t.Fatalf("Expected the idle connection to be closed forcibly, got %d", n)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The active connection was not closed after ActiveTimeout")
+	}
+	if n := server.ForceClosedCount(); n != 2 {
+		t.Fatalf("Expected 2 connections closed forcibly, got %d", n)
+	}
+}
+
+// Tests that the drain waits for the goroutines started with Go, and that Go
+// refuses work once the server has drained.
+func TestGo(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool, 1)
+	server := NewServer()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- server.Go(func() { <-release })
+	})
+	addr, exited := startServer(t, server, handler)
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !<-started {
+		t.Fatal("Expected Go to accept work while serving")
+	}
+	server.Close()
+	select {
+	case <-server.Done():
+		t.Fatal("The server drained while a goroutine was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if server.Go(func() {}) {
+		t.Fatal("Expected Go to refuse work after the drain")
+	}
+}
+
+// Tests that Go accepts work while the server still accepts connections
+// during MinDrainDuration, even with none open, and that the drain waits
+// for it.
+func TestGoDuringMinDrainDuration(t *testing.T) {
+	release := make(chan bool)
+	server := NewServer()
+	server.MinDrainDuration = 100 * time.Millisecond
+	_, exited := startServer(t, server, newTestHandler())
+	<-server.Listening()
+
+	server.Close()
+	if !server.Go(func() { <-release }) {
+		t.Fatal("Expected Go to accept work during MinDrainDuration")
+	}
+	tracked := httptest.NewRecorder()
+	server.TrackRequests(newTestHandler()).ServeHTTP(tracked, httptest.NewRequest("GET", "/", nil))
+	if tracked.Code != http.StatusOK {
+		t.Fatalf("Expected a tracked request during MinDrainDuration to be served, got %d", tracked.Code)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("Serve returned while a goroutine was running: %v", err)
+	case <-time.After(2 * server.MinDrainDuration):
+	}
+	close(release)
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that DrainDuration reports how long the drain took once it is over.
+func TestDrainDuration(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	go http.Get("http://" + addr)
+	<-ready
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	if d := server.DrainDuration(); d != 0 {
+		t.Fatalf("Expected no drain duration during the drain, got %v", d)
+	}
+	close(release)
+	<-exited
+	if d := server.DrainDuration(); d < 50*time.Millisecond || d > 5*time.Second {
+		t.Fatalf("Expected a drain duration of about 50ms, got %v", d)
+	}
+}
+
+// Tests that ListenAndServe binds its listener with ListenConfig.
+func TestListenConfig(t *testing.T) {
+	server := NewServer()
+	var controlled int32
+	server.ListenConfig = &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			atomic.AddInt32(&controlled, 1)
+			return nil
+		},
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServe("127.0.0.1:0", newTestHandler())
+	}()
+	<-server.Listening()
+	if atomic.LoadInt32(&controlled) != 1 {
+		t.Fatal("Expected the listener to be created with the ListenConfig")
+	}
+
+	resp, err := http.Get("http://" + server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that after Drain a server with a MaintenanceHandler keeps accepting
+// connections and serves them the maintenance page until it is closed.
+func TestMaintenanceHandler(t *testing.T) {
+	server := NewServer()
+	server.MaintenanceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	})
+	addr, exited := startServer(t, server, newTestHandler())
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func() int {
+		resp, err := client.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("Expected the handler to serve before Drain, got %d", code)
+	}
+	if err := server.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the maintenance page after Drain, got %d", code)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := client.Get("http://" + addr); err == nil {
+		t.Fatal("Expected the listener to be closed after Close")
+	}
+}
+
+// Tests that ActiveRequestCount counts the requests in flight, and that with
+// WaitForRequestsNotConnections the drain ends with the last request even
+// though a connection that never sent one is still open.
+func TestWaitForRequestsNotConnections(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.WaitForRequestsNotConnections = true
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	unused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unused.Close()
+	go http.Get("http://" + addr)
+	<-ready
+	if n := server.ActiveRequestCount(); n != 1 {
+		t.Fatalf("Expected 1 active request, got %d", n)
+	}
+	waitFor(t, func() bool { return server.ConnectionCount() == 2 })
+	server.Close()
+
+	select {
+	case <-exited:
+		t.Fatal("Serve returned while a request was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The unused connection held up the drain")
+	}
+	if n := server.ActiveRequestCount(); n != 0 {
+		t.Fatalf("Expected no active requests, got %d", n)
+	}
+}
+
+// Tests that CloseWithin waits up to its deadline, and closes the remaining
+// connections right away without one.
+func TestCloseWithin(t *testing.T) {
+	for _, d := range []time.Duration{50 * time.Millisecond, 0} {
+		ready := make(chan bool)
+		release := make(chan bool)
+		server := NewServer()
+		addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+		go http.Get("http://" + addr)
+		<-ready
+
+		start := time.Now()
+		if server.CloseWithin(d) {
+			t.Fatalf("%v: expected the connection to be closed forcibly", d)
+		}
+		if elapsed := time.Since(start); elapsed < d {
+			t.Fatalf("%v: returned after only %v", d, elapsed)
+		}
+		if n := server.ForceClosedCount(); n != 1 {
+			t.Fatalf("%v: expected 1 connection closed forcibly, got %d", d, n)
+		}
+		close(release)
+		<-exited
+	}
+
+	server := NewServer()
+	_, exited := startServer(t, server, newTestHandler())
+	<-server.Listening()
+	if !server.CloseWithin(0) {
+		t.Fatal("Expected an idle server to drain")
+	}
+	<-exited
+}
+
+// Tests that ListenAndServeAll serves on every local address and closes all
+// of them together.
+func TestListenAndServeAll(t *testing.T) {
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServeAll("0", newTestHandler())
+	}()
+	<-server.Listening()
+
+	server.mu.Lock()
+	var addrs []string
+	for _, l := range server.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	server.mu.Unlock()
+	loopback := false
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "127.0.0.1:") {
+			loopback = true
+		}
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if !loopback {
+		t.Fatalf("Expected to listen on the loopback address, got %v", addrs)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Fatalf("Expected %s to be closed", addr)
+		}
+	}
+}
+
+// Tests that a client sending its headers slowly is cut off after
+// ReadHeaderTimeout instead of holding up the drain.
+func TestReadHeaderTimeout(t *testing.T) {
+	server := NewServer(WithReadHeaderTimeout(200 * time.Millisecond))
+	addr, exited := startServer(t, server, newTestHandler())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return server.ConnectionCount() == 1 })
+	server.Close()
+
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the slow connection to be closed after ReadHeaderTimeout")
+	}
+	if n := server.ForceClosedCount(); n != 0 {
+		t.Fatalf("Expected the inner server to close the connection, got %d closed forcibly", n)
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected no connections left, got %d", n)
+	}
+}
+
+// Tests that the ReadinessFile exists while the server is serving and is
+// removed when Close is called.
+func TestReadinessFile(t *testing.T) {
+	server := NewServer()
+	server.ReadinessFile = filepath.Join(t.TempDir(), "ready")
+	server.MinDrainDuration = 100 * time.Millisecond
+	_, exited := startServer(t, server, newTestHandler())
+	<-server.Listening()
+	if _, err := os.Stat(server.ReadinessFile); err != nil {
+		t.Fatalf("Expected the readiness file to exist once listening: %v", err)
+	}
+
+	server.Close()
+	if _, err := os.Stat(server.ReadinessFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the readiness file to be removed by Close, got %v", err)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that the package-level Serve serves with the http.Server's handler
+// and ConnState, and drains once the http.Server is shut down.
+func TestServeHTTPServer(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	var states int32
+	srv := &http.Server{
+		Handler:   newWedgedHandler(ready, release),
+		ConnState: func(net.Conn, http.ConnState) { atomic.AddInt32(&states, 1) },
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- Serve(l, srv) }()
+
+	go http.Get("http://" + l.Addr().String())
+	<-ready
+	if atomic.LoadInt32(&states) == 0 {
+		t.Fatal("Expected the http.Server's ConnState to be called")
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("Serve returned before the request finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Undrain binds the listener Drain closed again and resumes
+// serving, and that it can't undo Close.
+func TestUndrain(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	addr, exited := startServer(t, server, mux)
+	<-server.Listening()
+	if err := server.Undrain(); err == nil {
+		t.Fatal("Expected an error undraining a server that isn't draining")
+	}
+
+	// Keep the drain from ending.
+	go http.Get("http://" + addr + "/wedged")
+	<-ready
+	server.Drain()
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("Expected the listener to be closed by Drain")
+	}
+
+	if err := server.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	if server.IsDraining() {
+		t.Fatal("Expected the server to no longer be draining")
+	}
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Expected the server to accept connections again: %v", err)
+	}
+	resp.Body.Close()
+	release <- true
+
+	server.Close()
+	if err := server.Undrain(); err == nil {
+		t.Fatal("Expected an error undraining after Close")
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Undrain binds a Unix socket served with ListenAndServeUnix
+// again with the same mode.
+func TestUndrainUnix(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	path := filepath.Join(t.TempDir(), "manners.sock")
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServeUnix(path, 0640, mux)
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+
+	// Keep the drain from ending.
+	<-server.Listening()
+	go client.Get("http://unix/wedged")
+	<-ready
+	server.Drain()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected the socket to be removed by Drain")
+	}
+	if err := server.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Fatalf("Expected mode 0640, got %v", fi.Mode().Perm())
+	}
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatalf("Expected the server to accept connections again: %v", err)
+	}
+	resp.Body.Close()
+
+	release <- true
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that Undrain has a listener from NewChanListener accept from the
+// same channel again.
+func TestUndrainChanListener(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	mux := http.NewServeMux()
+	mux.Handle("/wedged", newWedgedHandler(ready, release))
+	mux.Handle("/", newTestHandler())
+	server := NewServer()
+	l, conns := NewChanListener(server)
+	exited := make(chan error, 1)
+	go func() { exited <- server.Serve(l, mux) }()
+
+	// Keep the drain from ending.
+	wedged, conn := net.Pipe()
+	defer wedged.Close()
+	conns <- conn
+	go io.WriteString(wedged, "GET /wedged HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	<-ready
+	server.Drain()
+	if err := server.Undrain(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	select {
+	case conns <- conn:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the listener to accept from the channel again")
+	}
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	release <- true
+	if resp, err = http.ReadResponse(bufio.NewReader(wedged), nil); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that ForceCloseOrder sets the order of the connections closed when
+// the ShutdownTimeout elapses.
+func TestForceCloseOrder(t *testing.T) {
+	for _, order := range []ForceCloseOrder{ForceCloseOldestFirst, ForceCloseNewestFirst} {
+		ready := make(chan bool)
+		release := make(chan bool)
+		server := NewServer()
+		server.ShutdownTimeout = 50 * time.Millisecond
+		server.ForceCloseOrder = order
+		var closed []string
+		server.OnForceClose = func(conn net.Conn) { closed = append(closed, conn.RemoteAddr().String()) }
+		addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+		var accepted []string
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+			<-ready
+			accepted = append(accepted, conn.LocalAddr().String())
+			time.Sleep(time.Millisecond)
+		}
+		server.Close()
+		<-exited
+		close(release)
+
+		if len(closed) != len(accepted) {
+			t.Fatalf("Expected %d connections closed forcibly, got %v", len(accepted), closed)
+		}
+		for i := range accepted {
+			want := accepted[i]
+			if order == ForceCloseNewestFirst {
+				want = accepted[len(accepted)-1-i]
+			}
+			if closed[i] != want {
+				t.Fatalf("Expected the connections to be closed in the order %v, got %v", accepted, closed)
+			}
+		}
+	}
+}
+
+// Tests that a connection's context carries ConnContext's values and is
+// cancelled before the connection is closed forcibly.
+func TestConnContextCancelledOnForceClose(t *testing.T) {
+	type key struct{}
+	server := NewServer(WithConnContext(func(ctx context.Context, conn net.Conn) context.Context {
+		return context.WithValue(ctx, key{}, "value")
+	}))
+	server.ShutdownTimeout = 50 * time.Millisecond
+	ready := make(chan bool)
+	cancelled := make(chan string, 1)
+	server.OnForceClose = func(conn net.Conn) {
+		select {
+		case v := <-cancelled:
+			cancelled <- v
+		case <-time.After(time.Second):
+			t.Error("Expected the context to be cancelled before the connection was closed")
+		}
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready <- true
+		<-r.Context().Done()
+		v, _ := r.Context().Value(key{}).(string)
+		cancelled <- v
+	})
+	addr, exited := startServer(t, server, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+	server.Close()
+	<-exited
+
+	if v := <-cancelled; v != "value" {
+		t.Fatalf("Expected the ConnContext value in the request context, got %q", v)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.MaxConnectionsPerIP = 2
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+		<-ready
+		conns = append(conns, conn)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("Expected a connection over the limit to be closed")
+	}
+	conn.Close()
+	if n := server.ConnectionCount(); n != 2 {
+		t.Fatalf("Expected 2 tracked connections, got %d", n)
+	}
+
+	release <- true
+	conns[0].Close()
+	waitFor(t, func() bool { return server.ConnectionCount() == 1 })
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+
+	close(release)
+	server.Close()
+	<-exited
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.connsPerIP) != 0 {
+		t.Fatalf("Expected no addresses left counted, got %v", server.connsPerIP)
+	}
+	if len(server.reservedIP) != 0 {
+		t.Fatalf("Expected no slots left reserved, got %v", server.reservedIP)
+	}
+}
+
+// Tests that the slot reserved for a connection that CountBytes wraps is
+// handed over to it and freed when it closes, so that a client making one
+// request after the other is never turned away.
+func TestMaxConnectionsPerIPCountBytes(t *testing.T) {
+	server := NewServer()
+	server.MaxConnectionsPerIP = 2
+	server.CountBytes = true
+	addr, exited := startServer(t, server, newTestHandler())
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	for i := 0; i < 2*server.MaxConnectionsPerIP; i++ {
+		resp, err := client.Get("http://" + addr)
+		if err != nil {
+			t.Fatalf("Request %d: %v", i, err)
+		}
+		resp.Body.Close()
+		waitFor(t, func() bool { return server.ConnectionCount() == 0 })
+	}
+
+	server.Close()
+	<-exited
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.connsPerIP) != 0 || len(server.reservedIP) != 0 {
+		t.Fatalf("Expected no addresses left counted, got %v and %v", server.connsPerIP, server.reservedIP)
+	}
+}
+
+// Tests that admitting a connection reserves its slot under
+// MaxConnectionsPerIP right away, so that a second connection from the same
+// address accepted before the first is tracked, as by another listener, is
+// turned away, and that a slot given back can be taken again.
+func TestMaxConnectionsPerIPReserves(t *testing.T) {
+	server := NewServer()
+	server.MaxConnectionsPerIP = 1
+	first := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	second := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1001}
+
+	ip, ok := server.admitIP(first)
+	if !ok || ip != "127.0.0.1" {
+		t.Fatalf("Expected the first connection to be admitted, got %q %v", ip, ok)
+	}
+	if _, ok := server.admitIP(second); ok {
+		t.Fatal("Expected the second connection to be turned away")
+	}
+	server.releaseIP(ip)
+	if _, ok := server.admitIP(second); !ok {
+		t.Fatal("Expected the released slot to be taken again")
+	}
+}
+
+func TestShutdownConnWriter(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		ready <- true
+		<-release
+	})
+	server := NewServer()
+	server.ShutdownTimeout = 20 * time.Millisecond
+	server.ShutdownConnWriteTimeout = 50 * time.Millisecond
+	server.ShutdownConnWriter = func(conn net.Conn) error {
+		if _, err := io.WriteString(conn, "event: shutdown\n\n"); err != nil {
+			return err
+		}
+		// A farewell that never finishes doesn't hold up the close.
+		<-release
+		return nil
+	}
+	addr, exited := startServer(t, server, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+	start := time.Now()
+	server.Close()
+	<-exited
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected ShutdownConnWriteTimeout to bound the farewell, took %v", d)
+	}
+
+	received, _ := io.ReadAll(conn)
+	if !strings.HasSuffix(string(received), "event: shutdown\n\n") {
+		t.Fatalf("Expected the farewell before the connection was closed, got %q", received)
+	}
+}
+
+type drainableFunc func(ctx context.Context) error
+
+func (f drainableFunc) Drain(ctx context.Context) error { return f(ctx) }
+
+func TestRegisterDrainable(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.ShutdownTimeout = 200 * time.Millisecond
+	errPool := errors.New("pool")
+	var open int
+	server.RegisterDrainable(drainableFunc(func(ctx context.Context) error {
+		open = server.ConnectionCount()
+		return errPool
+	}))
+	server.RegisterDrainable(drainableFunc(func(ctx context.Context) error {
+		// Stuck until the ShutdownTimeout elapses.
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n"))
+	<-ready
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+
+	err = server.ShutdownContext(context.Background())
+	if !errors.Is(err, errPool) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the errors of both Drainables, got %v", err)
+	}
+	if open != 0 {
+		t.Fatalf("Expected Drain to be called once the connections had drained, %d were open", open)
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that the connections closed forcibly are told apart by whether they
+// were in the middle of a request.
+func TestForceClosedActiveIdle(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := NewServer()
+	server.KeepIdleOnShutdown = true
+	server.ShutdownTimeout = 50 * time.Millisecond
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	active, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	active.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+	// A connection that hasn't sent a request yet is as harmless to close
+	// as an idle one.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	waitFor(t, func() bool { return server.ConnectionCount() == 2 })
+
+	server.Close()
+	<-exited
+	if n := server.ForceClosedActive(); n != 1 {
+		t.Fatalf("Expected 1 active connection closed forcibly, got %d", n)
+	}
+	if n := server.ForceClosedIdle(); n != 1 {
+		t.Fatalf("Expected 1 idle connection closed forcibly, got %d", n)
+	}
+}
+
+func TestStaggerForceClose(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := NewServer()
+	server.ShutdownTimeout = 20 * time.Millisecond
+	server.StaggerForceClose = 200 * time.Millisecond
+	server.ForceCloseOrder = ForceCloseOldestFirst
+	var mu sync.Mutex
+	var closedAt []time.Duration
+	var start time.Time
+	server.OnForceClose = func(net.Conn) {
+		mu.Lock()
+		closedAt = append(closedAt, time.Since(start))
+		mu.Unlock()
+	}
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+		<-ready
+	}
+	start = time.Now()
+	server.Close()
+	<-exited
+
+	if len(closedAt) != 3 {
+		t.Fatalf("Expected 3 connections closed forcibly, got %d", len(closedAt))
+	}
+	if closedAt[2]-closedAt[0] < 100*time.Millisecond {
+		t.Fatalf("Expected the closes to be spread over the window, got %v", closedAt)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected Serve to return once the last connection was closed, took %v", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	server := NewServer()
+	_, exited := startServer(t, server, nil)
+	<-server.Listening()
+	server.Close()
+	<-exited
+	if err := server.Wait(); err != nil {
+		t.Fatalf("Expected nil after a clean drain, got %v", err)
+	}
+
+	ready := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server = NewServer()
+	server.ShutdownTimeout = 20 * time.Millisecond
+	addr, _ := startServer(t, server, newWedgedHandler(ready, release))
+	go http.Get("http://" + addr)
+	<-ready
+	server.Close()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- server.Wait() }()
+	}
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if !errors.Is(err, ErrServerClosed) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected a deadline error after a forced close, got %v", err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	server = NewServer()
+	go server.Serve(NewListener(&brokenListener{Listener: l}, server), nil)
+	if err := server.Wait(); err == nil || err.Error() != "broken" {
+		t.Fatalf("Expected the error Serve failed with, got %v", err)
+	}
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	server = NewServer()
+	go server.ListenAndServe(taken.Addr().String(), nil)
+	waited := make(chan error, 1)
+	go func() { waited <- server.Wait() }()
+	select {
+	case err := <-waited:
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatalf("Expected the error binding the address, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after ListenAndServe failed to listen")
+	}
+}
+
+// Tests that a server that doesn't track its connections returns from Serve
+// as soon as it is closed, leaving the requests in flight running.
+func TestTrackingDisabled(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.DisableTracking = true
+	server.TrackHijacked = true
+	var states int32
+	server.StateChanged = func(net.Conn, http.ConnState) { atomic.AddInt32(&states, 1) }
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	<-ready
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected no connection to be tracked, got %d", n)
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	close(release)
+	if resp := <-responses; resp != nil {
+		resp.Body.Close()
+	}
+	if atomic.LoadInt32(&states) == 0 {
+		t.Fatal("Expected StateChanged to be called")
+	}
+}
+
+// Tests that a server that only counts its connections still waits for them
+// when it is closed.
+func TestCountOnly(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	server.CountOnly = true
+	server.CountBytes = true
+	addr, exited := startServer(t, server, newWedgedHandler(ready, release))
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	<-ready
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected 1 connection to be counted, got %d", n)
+	}
+	if stats := server.ConnectionStats(); len(stats) != 0 {
+		t.Fatalf("Expected no connection to be recorded, got %d", len(stats))
+	}
+	server.Close()
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected Serve to wait for the request, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if resp := <-responses; resp != nil {
+		resp.Body.Close()
+	}
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := server.ConnectionCount(); n != 0 {
+		t.Fatalf("Expected no connection to be counted, got %d", n)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.pending) != 0 || len(server.cancels) != 0 {
+		t.Fatal("Expected no connection to be left in pending or cancels")
+	}
+}
+
+// Tests that requests served by a handler behind a hijacked connection, as
+// h2c serves HTTP/2 streams, are waited for when wrapped by TrackRequests.
+func TestTrackRequests(t *testing.T) {
+	ready := make(chan bool)
+	release := make(chan bool)
+	server := NewServer()
+	stopped := make(chan bool, 1)
+	server.GRPCGracefulStop = func() { stopped <- true }
+	tracked := server.TrackRequests(newWedgedHandler(ready, release))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		tracked.ServeHTTP(httptest.NewRecorder(), r)
+	})
+	addr, exited := startServer(t, server, handler)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-ready
+	waitFor(t, func() bool { return server.ConnectionCount() == 0 })
+
+	server.Close()
+	<-stopped
+	select {
+	case err := <-exited:
+		t.Fatalf("Expected Serve to wait for the tracked request, it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	tracked.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a request after the drain to be refused, got %d", w.Code)
+	}
+}
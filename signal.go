@@ -0,0 +1,44 @@
+package manners
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Closes the server when one of the given signals is received. With no
+// arguments it listens for SIGINT and SIGTERM. Calling it again replaces
+// the previous registration. The returned function stops listening for the
+// signals; it is also done for you once the server is closed.
+func (s *GracefulServer) HandleSignals(sigs ...os.Signal) (cancel func()) {
+	s.init()
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	c := make(chan os.Signal, 1)
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel = func() { once.Do(func() { close(stop) }) }
+
+	s.mu.Lock()
+	if s.signals != nil {
+		s.signals()
+	}
+	s.signals = cancel
+	closed := s.closed
+	s.mu.Unlock()
+
+	signal.Notify(c, sigs...)
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case <-c:
+			s.Close()
+		case <-stop:
+		case <-closed:
+		}
+	}()
+	return cancel
+}
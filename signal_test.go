@@ -0,0 +1,54 @@
+//go:build !windows
+
+package manners
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Tests that the server shuts down when it receives a signal.
+func TestHandleSignals(t *testing.T) {
+	server := NewServer()
+	_, exited := startServer(t, server, newTestHandler())
+	defer server.HandleSignals(syscall.SIGUSR1)()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	select {
+	case err := <-exited:
+		if err != ErrServerClosed {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not shut down on the signal")
+	}
+}
+
+// Tests that a cancelled registration no longer closes the server, and that
+// registering twice doesn't leave the first registration behind.
+func TestHandleSignalsCancel(t *testing.T) {
+	server := NewServer()
+	_, exited := startServer(t, server, newTestHandler())
+	server.HandleSignals(syscall.SIGUSR2)
+	server.HandleSignals(syscall.SIGUSR2)()
+
+	// Keep SIGUSR2 caught so it doesn't kill the test binary.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	defer signal.Stop(c)
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+	<-c
+
+	select {
+	case <-exited:
+		t.Fatal("The server shut down after its signal handler was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,39 @@
+package manners
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// The first file descriptor systemd passes to a socket-activated service.
+const listenFdsStart = 3
+
+// Creates a GracefulListener from the socket systemd opened for this process
+// through socket activation, as described by the LISTEN_PID and LISTEN_FDS
+// environment variables. Only the first socket is used. Returns an error if
+// the variables are missing or meant for another process, so the caller can
+// fall back to ListenAndServe.
+func ListenSystemd(s *GracefulServer) (*GracefulListener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, errors.New("manners: not socket activated: LISTEN_PID or LISTEN_FDS is not set")
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("manners: LISTEN_PID is %s, not this process", pid)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("manners: invalid LISTEN_FDS %q", fds)
+	}
+
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(listenFdsStart, "LISTEN_FD_3")
+	defer f.Close()
+	return NewListenerFromFile(f, s)
+}
@@ -0,0 +1,28 @@
+package manners
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Tests that ListenSystemd refuses to run without socket activation.
+func TestListenSystemdNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if _, err := ListenSystemd(NewServer()); err == nil {
+		t.Fatal("Expected an error without LISTEN_PID and LISTEN_FDS")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := ListenSystemd(NewServer()); err == nil {
+		t.Fatal("Expected an error when LISTEN_PID is another process")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	if _, err := ListenSystemd(NewServer()); err == nil {
+		t.Fatal("Expected an error when no sockets are passed")
+	}
+}
@@ -0,0 +1,207 @@
+package manners
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Like Serve, but over TLS with the given configuration, which is cloned
+// rather than modified. The listener passed must wrap a GracefulListener;
+// the TLS layer is added on top of it. HTTP/2 is negotiated with clients
+// that support it, as with ListenAndServeTLS. The configuration built from
+// config for the inner server takes the place of InnerServer's TLSConfig
+// while the server is serving, and Reset puts back the one set before.
+func (s *GracefulServer) ServeTLS(listener net.Listener, config *tls.Config, handler http.Handler) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	// The inner server clones TLSConfig once more when it starts, so the
+	// session tickets are encrypted with the keys of a configuration kept
+	// here instead, which SetSessionTicketKeys can update.
+	tickets := config.Clone()
+	inner := config.Clone()
+	if inner.WrapSession == nil && inner.UnwrapSession == nil {
+		inner.WrapSession = tickets.EncryptTicket
+		inner.UnwrapSession = tickets.DecryptTicket
+	}
+	if s.InspectClientHello != nil {
+		inner.GetConfigForClient = s.inspectClientHello(config.GetConfigForClient)
+	}
+	s.mu.Lock()
+	s.tickets = tickets
+	s.tlsConfig = s.callerTLSConfig()
+	s.derivedTLSConfig = inner
+	s.InnerServer.TLSConfig = inner
+	s.mu.Unlock()
+	// The inner server's ServeTLS configures HTTP/2 and advertises it
+	// through ALPN. It takes the certificates from TLSConfig.
+	return s.serve(listener, handler, func(l net.Listener) error {
+		return s.InnerServer.ServeTLS(l, "", "")
+	})
+}
+
+// Like ListenAndServeTLS, but with a TLS configuration built by the caller,
+// for instance to verify client certificates or to pick certificates by
+// SNI. The configuration is cloned rather than modified.
+func (s *GracefulServer) ListenAndServeTLSConfig(addr string, config *tls.Config, handler http.Handler) error {
+	oldListener, err := s.listen(addr)
+	if err != nil {
+		return s.listenFailed(err)
+	}
+
+	listener := NewListener(oldListener, s)
+	return s.ServeTLS(listener, config, handler)
+}
+
+// Like ListenAndServeTLS on httpsAddr, but also listens on httpAddr and
+// redirects every request made there to the same path and query over
+// HTTPS, on the host named by its Host header and the port httpsAddr is
+// bound to. The redirects are served by
+// a second GracefulServer with the same ShutdownTimeout and Logger, which
+// is closed along with this one and drained within the same ShutdownTimeout
+// through RegisterDrainable, so Serve returns once both have drained. An
+// error serving the redirects closes this server as well.
+func (s *GracefulServer) ListenAndServeTLSRedirect(httpAddr, httpsAddr, certFile, keyFile string, handler http.Handler) error {
+	httpsListener, err := s.listen(httpsAddr)
+	if err != nil {
+		return s.listenFailed(err)
+	}
+	httpListener, err := s.listen(httpAddr)
+	if err != nil {
+		httpsListener.Close()
+		return s.listenFailed(err)
+	}
+	redirect := NewServer()
+	redirect.ShutdownTimeout = s.ShutdownTimeout
+	redirect.Logger = s.Logger
+	s.RegisterOnShutdown(func() { redirect.Close() })
+	s.RegisterDrainable(drainFunc(redirect.ShutdownContext))
+	go func() {
+		err := redirect.Serve(NewListener(httpListener, redirect), redirectToTLS(httpsListener.Addr()))
+		if err != ErrServerClosed {
+			s.logf("manners: error serving HTTPS redirects: %v", err)
+			s.Close()
+		}
+	}()
+	err = s.serveTLS(NewListener(httpsListener, s), handler, certFile, keyFile)
+	if err != ErrServerClosed {
+		redirect.Close()
+	}
+	return err
+}
+
+// Returns a handler that redirects to the same URL over HTTPS, on the port
+// of addr.
+func redirectToTLS(addr net.Addr) http.Handler {
+	port := ""
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.Port != 443 {
+		port = strconv.Itoa(tcp.Port)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Like Serve, but over TLS with the certificate in certFile and keyFile.
+// The certificate is served through GetCertificate so that ReloadTLS can
+// replace it.
+func (s *GracefulServer) serveTLS(listener net.Listener, handler http.Handler, certFile, keyFile string) error {
+	if err := s.ReloadTLS(certFile, keyFile); err != nil {
+		listener.Close()
+		return s.listenFailed(err)
+	}
+	s.mu.Lock()
+	config := s.callerTLSConfig().Clone()
+	s.mu.Unlock()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.GetCertificate = s.getCertificate
+	return s.ServeTLS(listener, config, handler)
+}
+
+// Returns InnerServer's TLSConfig as it was set by the caller, rather than
+// the configuration ServeTLS built from it. Must be called with s.mu held.
+func (s *GracefulServer) callerTLSConfig() *tls.Config {
+	if s.derivedTLSConfig != nil && s.InnerServer.TLSConfig == s.derivedTLSConfig {
+		return s.tlsConfig
+	}
+	return s.InnerServer.TLSConfig
+}
+
+// Loads a new certificate and key and serves them to every client that
+// connects from now on. Connections that are already open are unaffected.
+// If the files can't be loaded, the old certificate stays in place.
+func (s *GracefulServer) ReloadTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	s.certificate.Store(&cert)
+	return nil
+}
+
+// Replaces the keys that encrypt TLS session tickets, in the manner of
+// tls.Config.SetSessionTicketKeys, so that they can be rotated while the
+// server is running. The first key encrypts new tickets and every key
+// decrypts them. Connections that are already open are unaffected. Returns
+// an error if the server isn't serving TLS, if keys is empty, or if the TLS
+// configuration has its own WrapSession or UnwrapSession.
+func (s *GracefulServer) SetSessionTicketKeys(keys [][32]byte) error {
+	s.mu.Lock()
+	tickets := s.tickets
+	s.mu.Unlock()
+	switch {
+	case tickets == nil:
+		return errors.New("manners: TLS is not configured")
+	case len(keys) == 0:
+		return errors.New("manners: no session ticket keys")
+	case tickets.WrapSession != nil || tickets.UnwrapSession != nil:
+		return errors.New("manners: session tickets are wrapped by the TLS configuration")
+	}
+	tickets.SetSessionTicketKeys(keys)
+	return nil
+}
+
+func (s *GracefulServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := s.certificate.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, errors.New("manners: no certificate loaded")
+	}
+	return cert, nil
+}
+
+var errClientHelloRejected = errors.New("manners: connection turned away by InspectClientHello")
+
+// Returns a GetConfigForClient that consults InspectClientHello before
+// next. A connection turned away stops being tracked right away, so that
+// the drain doesn't wait for it to be closed.
+func (s *GracefulServer) inspectClientHello(next func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !s.InspectClientHello(hello) {
+			conns := s.takeConns(func(tc *trackedConn) bool {
+				nc, ok := tc.conn.(netConner)
+				return ok && nc.NetConn() == hello.Conn
+			})
+			s.releaseTaken(len(conns))
+			return nil, errClientHelloRejected
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
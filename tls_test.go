@@ -0,0 +1,344 @@
+package manners
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Returns the serial number of the certificate the server at addr presents.
+func servedSerial(t *testing.T, addr string) *big.Int {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+// Tests that ReloadTLS swaps the certificate for new connections, and keeps
+// the old one if the new one can't be loaded.
+func TestReloadTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	newCertFile, newKeyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), newTestHandler(), certFile, keyFile)
+	}()
+	addr := l.Addr().String()
+
+	before := servedSerial(t, addr)
+	if err := server.ReloadTLS(newCertFile, newCertFile); err == nil {
+		t.Fatal("Expected an error loading a mismatched key")
+	}
+	if got := servedSerial(t, addr); got.Cmp(before) != 0 {
+		t.Fatal("The certificate changed after a failed reload")
+	}
+	if err := server.ReloadTLS(newCertFile, newKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, addr); got.Cmp(before) == 0 {
+		t.Fatal("The certificate didn't change after a reload")
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests serving with a TLS configuration built by the caller, which must be
+// left unmodified.
+func TestServeTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ServeTLS(NewListener(l, server), config, newTestHandler())
+	}()
+
+	resp, err := newTLSClient().Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got HTTP/%d", resp.ProtoMajor)
+	}
+	if len(config.NextProtos) != 0 {
+		t.Fatalf("The caller's configuration was modified: NextProtos %v", config.NextProtos)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that SetSessionTicketKeys rotates the keys that sessions are resumed
+// with.
+func TestSetSessionTicketKeys(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	if err := server.SetSessionTicketKeys([][32]byte{{1}}); err == nil {
+		t.Fatal("Expected an error before TLS is configured")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), newTestHandler(), certFile, keyFile)
+	}()
+
+	// TLS 1.2 sends the ticket during the handshake.
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		MaxVersion:         tls.VersionTLS12,
+	}
+	resumed := func() bool {
+		conn, err := tls.Dial("tcp", l.Addr().String(), client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+	steps := []struct {
+		keys    [][32]byte
+		resumed []bool
+	}{
+		{nil, []bool{false, true}},
+		{[][32]byte{{1}}, []bool{false, true}},
+		{[][32]byte{{2}, {1}}, []bool{true}},
+	}
+	for i, step := range steps {
+		if step.keys != nil {
+			if err := server.SetSessionTicketKeys(step.keys); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j, want := range step.resumed {
+			if got := resumed(); got != want {
+				t.Fatalf("Step %d, connection %d: expected resumed %v, got %v", i, j, want, got)
+			}
+		}
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a connection that never completes its TLS handshake is closed
+// after HandshakeTimeout, while HTTP/2 connections outlive it.
+func TestHandshakeTimeout(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.HandshakeTimeout = 100 * time.Millisecond
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), newTestHandler(), certFile, keyFile)
+	}()
+
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stalled.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the stalled connection to be closed, got %v", err)
+	}
+
+	client := newTLSClient()
+	resp, err := client.Get("https://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2, got HTTP/%d", resp.ProtoMajor)
+	}
+	time.Sleep(3 * server.HandshakeTimeout)
+	if n := server.ConnectionCount(); n != 1 {
+		t.Fatalf("Expected the HTTP/2 connection to stay open, got %d connections", n)
+	}
+
+	client.CloseIdleConnections()
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a connection InspectClientHello turns away fails its handshake
+// and isn't counted by the drain, while the others are served.
+func TestInspectClientHello(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer()
+	server.InnerServer.ErrorLog = log.New(io.Discard, "", 0)
+	server.MinDrainDuration = 200 * time.Millisecond
+	server.InspectClientHello = func(hello *tls.ClientHelloInfo) bool {
+		return hello.ServerName != "elsewhere.test"
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.serveTLS(NewListener(l, server), newTestHandler(), certFile, keyFile)
+	}()
+	addr := l.Addr().String()
+	<-server.Listening()
+	// Connect during the drain, so that the served connection is counted.
+	server.Close()
+
+	_, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "elsewhere.test"})
+	if err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: "local.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&server.acceptedCount); n != 2 {
+		t.Fatalf("Expected 2 connections accepted, got %d", n)
+	}
+	if n := server.DrainedCount(); n != 1 {
+		t.Fatalf("Expected only the served connection to be counted, got %d", n)
+	}
+}
+
+// Tests that Reset puts back the TLSConfig set on InnerServer, so that a
+// second TLS serve builds its configuration from that one afresh.
+func TestResetServeTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	server := NewServer()
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	server.InnerServer.TLSConfig = config
+	var inspected int32
+	server.InspectClientHello = func(*tls.ClientHelloInfo) bool {
+		atomic.AddInt32(&inspected, 1)
+		return true
+	}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		exited := make(chan error, 1)
+		go func() {
+			exited <- server.serveTLS(NewListener(l, server), newTestHandler(), certFile, keyFile)
+		}()
+		<-server.Listening()
+		if err := server.SetSessionTicketKeys([][32]byte{{byte(i + 1)}}); err != nil {
+			t.Fatalf("Serve %d: %v", i, err)
+		}
+		atomic.StoreInt32(&inspected, 0)
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if n := atomic.LoadInt32(&inspected); n != 1 {
+			t.Fatalf("Serve %d: expected InspectClientHello to be called once, got %d", i, n)
+		}
+
+		server.Close()
+		if err := <-exited; err != ErrServerClosed {
+			t.Fatal(err)
+		}
+		if err := server.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if server.InnerServer.TLSConfig != config {
+			t.Fatalf("Serve %d: expected Reset to put back the TLSConfig that was set", i)
+		}
+	}
+}
+
+func TestListenAndServeTLSRedirect(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	server := NewServer()
+	listeners := make(chan net.Listener, 2)
+	server.ListenerFactory = func(addr string) (net.Listener, error) {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			listeners <- l
+		}
+		return l, err
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure")
+	})
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.ListenAndServeTLSRedirect("127.0.0.1:0", "127.0.0.1:0", certFile, keyFile, handler)
+	}()
+	httpsAddr := (<-listeners).Addr().String()
+	httpAddr := (<-listeners).Addr().String()
+	<-server.Listening()
+
+	client := newTLSClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get("http://" + httpAddr + "/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := "https://" + httpsAddr + "/path?q=1"
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != want {
+		t.Fatalf("Expected a redirect to %s, got %d to %q", want, resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, err = client.Get(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure" {
+		t.Fatalf("Expected the handler's response over HTTPS, got %q", body)
+	}
+
+	server.Close()
+	if err := <-exited; err != ErrServerClosed {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", httpAddr); err == nil {
+		t.Fatal("Expected the redirect listener to be closed along with the server")
+	}
+}